@@ -0,0 +1,238 @@
+// Package admin serves an HTTP control port for inspecting and adjusting running
+// servers. It only listens on loopback addresses.
+//
+//	GET  /                        names of the registered targets
+//	GET  /{target}/conns          live connections or peers as JSON
+//	POST /{target}/conns/{id}/kick
+//	GET  /{target}/conns/{id}/tcp_info   a fresh TCP_INFO sample
+//	GET  /{target}/settings       current settings as JSON
+//	POST /{target}/settings       change settings given as form values, e.g.
+//	                              curl -d packet_loss=0.2 localhost:9100/udp/settings
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/pixperk/bloodsport/day1_tcp_udp/tcpinfo"
+)
+
+// ErrNotFound is returned by a Kicker for an ID with no live connection.
+var ErrNotFound = errors.New("no such connection")
+
+// shutdownTimeout bounds in-flight admin requests once the Serve context is cancelled.
+const shutdownTimeout = 2 * time.Second
+
+type Conn struct {
+	ID           string            `json:"id"`
+	RemoteAddr   string            `json:"remote_addr"`
+	ConnectedAt  time.Time         `json:"connected_at"`
+	LastActivity time.Time         `json:"last_activity"`
+	BytesIn      uint64            `json:"bytes_in"`
+	BytesOut     uint64            `json:"bytes_out"`
+	Info         map[string]string `json:"info,omitempty"`
+
+	// TCPInfo is the latest periodic TCP_INFO sample, if the target takes them.
+	TCPInfo *tcpinfo.Info `json:"tcp_info,omitempty"`
+}
+
+// Target is a server the admin port can list connections for.
+type Target interface {
+	Conns() []Conn
+}
+
+// Kicker is implemented by targets that can drop a single connection.
+type Kicker interface {
+	Kick(id string) error
+}
+
+// TCPInfoSampler is implemented by targets that can sample a connection's TCP_INFO on
+// demand.
+type TCPInfoSampler interface {
+	TCPInfo(id string) (tcpinfo.Info, error)
+}
+
+// Configurable is implemented by targets with settings that can change at runtime.
+// Set validates every value before applying any, so a request with one bad value
+// changes nothing.
+type Configurable interface {
+	Settings() map[string]any
+	Set(values map[string]string) error
+}
+
+// Handler routes admin requests to targets by name.
+func Handler(targets map[string]Target) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		names := make([]string, 0, len(targets))
+		for name := range targets {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		writeJSON(w, names)
+	})
+
+	mux.HandleFunc("GET /{target}/conns", func(w http.ResponseWriter, r *http.Request) {
+		if t, ok := lookup(w, r, targets); ok {
+			writeJSON(w, t.Conns())
+		}
+	})
+
+	mux.HandleFunc("POST /{target}/conns/{id}/kick", func(w http.ResponseWriter, r *http.Request) {
+		t, ok := lookup(w, r, targets)
+		if !ok {
+			return
+		}
+		k, ok := t.(Kicker)
+		if !ok {
+			http.Error(w, "target does not support kicking connections", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := k.Kick(r.PathValue("id")); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("GET /{target}/conns/{id}/tcp_info", func(w http.ResponseWriter, r *http.Request) {
+		t, ok := lookup(w, r, targets)
+		if !ok {
+			return
+		}
+		ts, ok := t.(TCPInfoSampler)
+		if !ok {
+			http.Error(w, "target has no TCP connections", http.StatusNotFound)
+			return
+		}
+		info, err := ts.TCPInfo(r.PathValue("id"))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, info)
+	})
+
+	mux.HandleFunc("GET /{target}/settings", func(w http.ResponseWriter, r *http.Request) {
+		if c, ok := configurable(w, r, targets); ok {
+			writeJSON(w, c.Settings())
+		}
+	})
+
+	mux.HandleFunc("POST /{target}/settings", func(w http.ResponseWriter, r *http.Request) {
+		c, ok := configurable(w, r, targets)
+		if !ok {
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		values := make(map[string]string, len(r.PostForm))
+		for name := range r.PostForm {
+			values[name] = r.PostForm.Get(name)
+		}
+		if err := c.Set(values); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, c.Settings())
+	})
+
+	return mux
+}
+
+// Serve listens on addr, which must be a loopback address, and serves Handler(targets)
+// until ctx is cancelled.
+func Serve(ctx context.Context, addr string, targets map[string]Target) error {
+	if err := checkLoopback(addr); err != nil {
+		return err
+	}
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return ServeListener(ctx, lis, targets)
+}
+
+// ServeListener is Serve on an existing listener, such as one inherited across an
+// upgrade. lis must be bound to a loopback address.
+func ServeListener(ctx context.Context, lis net.Listener, targets map[string]Target) error {
+	if err := checkLoopback(lis.Addr().String()); err != nil {
+		lis.Close()
+		return err
+	}
+
+	srv := &http.Server{Handler: Handler(targets), ReadHeaderTimeout: 5 * time.Second}
+	stop := context.AfterFunc(ctx, func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	})
+	defer stop()
+
+	fmt.Printf("admin listening on http://%v\n", lis.Addr())
+	if err := srv.Serve(lis); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func checkLoopback(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("admin: refusing to listen on non-loopback address %q", addr)
+	}
+	return nil
+}
+
+func lookup(w http.ResponseWriter, r *http.Request, targets map[string]Target) (Target, bool) {
+	t, ok := targets[r.PathValue("target")]
+	if !ok {
+		http.Error(w, "unknown target", http.StatusNotFound)
+	}
+	return t, ok
+}
+
+func configurable(w http.ResponseWriter, r *http.Request, targets map[string]Target) (Configurable, bool) {
+	t, ok := lookup(w, r, targets)
+	if !ok {
+		return nil, false
+	}
+	c, ok := t.(Configurable)
+	if !ok {
+		http.Error(w, "target has no settings", http.StatusNotFound)
+	}
+	return c, ok
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	switch {
+	case errors.Is(err, ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, errors.ErrUnsupported):
+		status = http.StatusNotImplemented
+	}
+	http.Error(w, err.Error(), status)
+}
@@ -0,0 +1,210 @@
+package admin
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"sync"
+
+	tcpserver "github.com/pixperk/bloodsport/day1_tcp_udp/tcp_echo/server"
+	chatserver "github.com/pixperk/bloodsport/day1_tcp_udp/tcp_multiclient_chat_n_file/server"
+	"github.com/pixperk/bloodsport/day1_tcp_udp/tcpinfo"
+	udpserver "github.com/pixperk/bloodsport/day1_tcp_udp/udp_echo/server"
+)
+
+// TCP exposes an echo TCPServer's connections and its connection limits.
+func TCP(s *tcpserver.TCPServer) Target {
+	return &tcpTarget{s: s}
+}
+
+type tcpTarget struct {
+	s *tcpserver.TCPServer
+
+	// setMu makes Set's read-modify-write of the limits atomic.
+	setMu sync.Mutex
+}
+
+func (t *tcpTarget) Conns() []Conn {
+	ccs := t.s.Conns()
+	conns := make([]Conn, 0, len(ccs))
+	for _, cc := range ccs {
+		c := Conn{
+			ID:           strconv.FormatUint(cc.ID, 10),
+			RemoteAddr:   cc.RemoteAddr.String(),
+			ConnectedAt:  cc.ConnectedAt,
+			LastActivity: cc.LastActivity(),
+			BytesIn:      cc.BytesIn(),
+			BytesOut:     cc.BytesOut(),
+		}
+		if info, ok := cc.LastTCPInfo(); ok {
+			c.TCPInfo = &info
+		}
+		if cc.PeerIdentity != "" || cc.ProxyAddr != nil {
+			c.Info = map[string]string{}
+			if cc.PeerIdentity != "" {
+				c.Info["peer_identity"] = cc.PeerIdentity
+			}
+			if cc.ProxyAddr != nil {
+				c.Info["proxy"] = cc.ProxyAddr.String()
+			}
+		}
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+func (t *tcpTarget) Kick(id string) error {
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil || !t.s.Kick(n) {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (t *tcpTarget) TCPInfo(id string) (tcpinfo.Info, error) {
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return tcpinfo.Info{}, ErrNotFound
+	}
+	cc, ok := t.s.Conn(n)
+	if !ok {
+		return tcpinfo.Info{}, ErrNotFound
+	}
+	return cc.TCPInfo()
+}
+
+func (t *tcpTarget) Settings() map[string]any {
+	maxConns, maxConnsPerIP := t.s.Limits()
+	return map[string]any{
+		"max_conns":        maxConns,
+		"max_conns_per_ip": maxConnsPerIP,
+	}
+}
+
+func (t *tcpTarget) Set(values map[string]string) error {
+	limits := make(map[string]int, len(values))
+	for _, name := range slices.Sorted(maps.Keys(values)) {
+		if name != "max_conns" && name != "max_conns_per_ip" {
+			return fmt.Errorf("%s: unknown setting", name)
+		}
+		n, err := strconv.Atoi(values[name])
+		if err != nil || n < 0 {
+			return fmt.Errorf("%s: want a non-negative integer, got %q", name, values[name])
+		}
+		limits[name] = n
+	}
+
+	t.setMu.Lock()
+	defer t.setMu.Unlock()
+	maxConns, maxConnsPerIP := t.s.Limits()
+	if n, ok := limits["max_conns"]; ok {
+		maxConns = n
+	}
+	if n, ok := limits["max_conns_per_ip"]; ok {
+		maxConnsPerIP = n
+	}
+	t.s.SetLimits(maxConns, maxConnsPerIP)
+	return nil
+}
+
+// Chat exposes the chat server's registered clients, keyed by client ID.
+func Chat(s *chatserver.Server) Target {
+	return chatTarget{s}
+}
+
+type chatTarget struct {
+	s *chatserver.Server
+}
+
+func (t chatTarget) Conns() []Conn {
+	clients := t.s.Clients()
+	conns := make([]Conn, 0, len(clients))
+	for _, c := range clients {
+		info := map[string]string{"name": c.Name}
+		if c.Identity != "" {
+			info["peer_identity"] = c.Identity
+		}
+		conn := Conn{
+			ID:           c.ID,
+			RemoteAddr:   c.Conn.RemoteAddr().String(),
+			ConnectedAt:  c.ConnectedAt,
+			LastActivity: c.LastActivity(),
+			BytesIn:      c.BytesIn(),
+			BytesOut:     c.BytesOut(),
+			Info:         info,
+		}
+		if ti, ok := c.LastTCPInfo(); ok {
+			conn.TCPInfo = &ti
+		}
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+func (t chatTarget) Kick(id string) error {
+	if !t.s.Kick(id) {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (t chatTarget) TCPInfo(id string) (tcpinfo.Info, error) {
+	c, ok := t.s.Client(id)
+	if !ok {
+		return tcpinfo.Info{}, ErrNotFound
+	}
+	return c.TCPInfo()
+}
+
+// UDP exposes the UDP echo server's recent peers and its simulated packet loss.
+// UDP has no connections to kick.
+func UDP(s *udpserver.UDPServer) Target {
+	return udpTarget{s}
+}
+
+type udpTarget struct {
+	s *udpserver.UDPServer
+}
+
+func (t udpTarget) Conns() []Conn {
+	peers := t.s.Peers()
+	conns := make([]Conn, 0, len(peers))
+	for _, p := range peers {
+		conns = append(conns, Conn{
+			ID:           p.Addr.String(),
+			RemoteAddr:   p.Addr.String(),
+			ConnectedAt:  p.FirstSeen,
+			LastActivity: p.LastSeen,
+			BytesIn:      p.BytesIn,
+			BytesOut:     p.BytesOut,
+			Info: map[string]string{
+				"packets_in":  strconv.FormatUint(p.PacketsIn, 10),
+				"packets_out": strconv.FormatUint(p.PacketsOut, 10),
+			},
+		})
+	}
+	return conns
+}
+
+func (t udpTarget) Settings() map[string]any {
+	return map[string]any{"packet_loss": t.s.PacketLoss()}
+}
+
+func (t udpTarget) Set(values map[string]string) error {
+	for _, name := range slices.Sorted(maps.Keys(values)) {
+		if name != "packet_loss" {
+			return fmt.Errorf("%s: unknown setting", name)
+		}
+	}
+	value, ok := values["packet_loss"]
+	if !ok {
+		return nil
+	}
+	p, err := strconv.ParseFloat(value, 64)
+	if err != nil || p < 0 || p > 1 {
+		return fmt.Errorf("packet_loss: want a probability between 0 and 1, got %q", value)
+	}
+	t.s.SetPacketLoss(p)
+	return nil
+}
@@ -0,0 +1,277 @@
+// Command bench drives concurrent echo clients against the TCP or UDP echo server and
+// reports throughput, error/loss rate and latency percentiles.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pixperk/bloodsport/day1_tcp_udp/admin"
+	tcpclient "github.com/pixperk/bloodsport/day1_tcp_udp/tcp_echo/client"
+	"github.com/pixperk/bloodsport/day1_tcp_udp/tcp_echo/framing"
+	tcpserver "github.com/pixperk/bloodsport/day1_tcp_udp/tcp_echo/server"
+	udpclient "github.com/pixperk/bloodsport/day1_tcp_udp/udp_echo/client"
+	udpserver "github.com/pixperk/bloodsport/day1_tcp_udp/udp_echo/server"
+)
+
+type config struct {
+	proto    string
+	addr     string
+	clients  int
+	messages int
+	rate     float64
+	size     int
+	codec    framing.Codec
+	timeout  time.Duration
+}
+
+func main() {
+	cfg := config{}
+	flag.StringVar(&cfg.proto, "proto", "tcp", "protocol to bench: tcp or udp")
+	flag.StringVar(&cfg.addr, "addr", "localhost:9000", "echo server address")
+	flag.IntVar(&cfg.clients, "clients", 10, "number of concurrent clients")
+	flag.IntVar(&cfg.messages, "messages", 1000, "messages sent by each client")
+	flag.Float64Var(&cfg.rate, "rate", 0, "target messages per second across all clients, 0 for as fast as possible")
+	flag.IntVar(&cfg.size, "size", 64, "payload size in bytes")
+	codecName := flag.String("codec", "newline", "tcp framing: newline, uvarint or u32be")
+	flag.DurationVar(&cfg.timeout, "timeout", 2*time.Second, "per-message timeout")
+	serve := flag.Bool("serve", false, "start an in-process echo server on -addr")
+	adminAddr := flag.String("admin", "", "with -serve, expose the server on this loopback admin address")
+	asJSON := flag.Bool("json", false, "print the report as JSON")
+	flag.Parse()
+
+	codec, err := framing.ByName(*codecName)
+	if err != nil {
+		fail(err)
+	}
+	cfg.codec = codec
+
+	if cfg.clients <= 0 || cfg.messages <= 0 {
+		fail(errors.New("-clients and -messages must be positive"))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if *serve {
+		target, err := startServer(ctx, cfg)
+		if err != nil {
+			fail(err)
+		}
+		if *adminAddr != "" {
+			go func() {
+				if err := admin.Serve(ctx, *adminAddr, map[string]admin.Target{cfg.proto: target}); err != nil {
+					fmt.Fprintf(os.Stderr, "admin: %v\n", err)
+				}
+			}()
+		}
+	}
+
+	report, err := run(ctx, cfg)
+	if err != nil {
+		fail(err)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+		return
+	}
+	report.WriteText(os.Stdout)
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "bench: %v\n", err)
+	os.Exit(1)
+}
+
+func startServer(ctx context.Context, cfg config) (admin.Target, error) {
+	switch cfg.proto {
+	case "tcp":
+		s := tcpserver.NewTCPServer(cfg.addr, tcpserver.EchoHandler(), tcpserver.WithCodec(cfg.codec))
+		errs := make(chan error, 1)
+		go func() { errs <- s.StartWithContext(ctx) }()
+		select {
+		case <-s.Ready():
+		case err := <-errs:
+			return nil, err
+		}
+		return admin.TCP(s), nil
+	case "udp":
+		s := udpserver.NewUDPServer(cfg.addr)
+		errs := make(chan error, 1)
+		go func() { errs <- s.Start(ctx) }()
+		select {
+		case <-s.Ready():
+		case err := <-errs:
+			return nil, err
+		}
+		return admin.UDP(s), nil
+	default:
+		return nil, fmt.Errorf("unknown protocol %q", cfg.proto)
+	}
+}
+
+func run(ctx context.Context, cfg config) (*Report, error) {
+	var worker func(ctx context.Context, id int, cfg config) result
+	switch cfg.proto {
+	case "tcp":
+		worker = tcpWorker
+	case "udp":
+		worker = udpWorker
+	default:
+		return nil, fmt.Errorf("unknown protocol %q", cfg.proto)
+	}
+
+	results := make([]result, cfg.clients)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := range cfg.clients {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = worker(ctx, i, cfg)
+		}(i)
+	}
+	wg.Wait()
+
+	report := &Report{
+		Proto:    cfg.proto,
+		Addr:     cfg.addr,
+		Clients:  cfg.clients,
+		Messages: cfg.messages,
+	}
+	buildReport(report, results, time.Since(start))
+	return report, nil
+}
+
+// pacer spaces one client's sends so all clients together hit the target rate.
+type pacer struct {
+	next     time.Time
+	interval time.Duration
+}
+
+func newPacer(cfg config) *pacer {
+	if cfg.rate <= 0 {
+		return &pacer{}
+	}
+	return &pacer{
+		next:     time.Now(),
+		interval: time.Duration(float64(cfg.clients) / cfg.rate * float64(time.Second)),
+	}
+}
+
+func (p *pacer) wait() {
+	if p.interval == 0 {
+		return
+	}
+	time.Sleep(time.Until(p.next))
+	p.next = p.next.Add(p.interval)
+}
+
+// payload returns a message unique to (client, seq) padded to size bytes.
+func payload(client, seq, size int) string {
+	msg := fmt.Sprintf("c%d-m%d-", client, seq)
+	if pad := size - len(msg); pad > 0 {
+		msg += strings.Repeat("x", pad)
+	}
+	return msg
+}
+
+func tcpWorker(ctx context.Context, id int, cfg config) result {
+	res := result{latencies: make([]time.Duration, 0, cfg.messages)}
+
+	connect := func() (*tcpclient.TCPClient, error) {
+		c := tcpclient.NewTCPClient(cfg.addr,
+			tcpclient.WithTimeout(cfg.timeout),
+			tcpclient.WithCodec(cfg.codec),
+		)
+		return c, c.Connect()
+	}
+	c, err := connect()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "client %d: %v\n", id, err)
+		res.sent, res.errors = cfg.messages, cfg.messages
+		return res
+	}
+	defer func() { c.Close() }()
+
+	p := newPacer(cfg)
+	for seq := range cfg.messages {
+		p.wait()
+		msg := payload(id, seq, cfg.size)
+
+		start := time.Now()
+		reply, err := c.RoundTrip(ctx, msg)
+		res.sent++
+		switch {
+		case err != nil:
+			res.errors++
+		case reply != "Echo: "+msg:
+			res.mismatches++
+		default:
+			res.ok++
+			res.latencies = append(res.latencies, time.Since(start))
+		}
+		if err == nil || seq == cfg.messages-1 {
+			continue
+		}
+
+		// a failed round trip may leave the connection closed, so carry on over a new one
+		c.Close()
+		if c, err = connect(); err != nil {
+			fmt.Fprintf(os.Stderr, "client %d: %v\n", id, err)
+			rest := cfg.messages - res.sent
+			res.sent, res.errors = cfg.messages, res.errors+rest
+			return res
+		}
+	}
+	return res
+}
+
+func udpWorker(ctx context.Context, id int, cfg config) result {
+	res := result{latencies: make([]time.Duration, 0, cfg.messages)}
+
+	c, err := udpclient.NewUDPClient(cfg.addr, cfg.timeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "client %d: %v\n", id, err)
+		res.sent, res.errors = cfg.messages, cfg.messages
+		return res
+	}
+	defer c.Close()
+
+	p := newPacer(cfg)
+	for seq := range cfg.messages {
+		if ctx.Err() != nil {
+			break
+		}
+		p.wait()
+		msg := payload(id, seq, cfg.size)
+
+		start := time.Now()
+		res.sent++
+		// Do matches the reply by request ID, so a late reply to a message already
+		// counted as lost cannot be taken for this one
+		reply, err := c.Do(ctx, []byte(msg))
+		switch {
+		case errors.Is(err, context.DeadlineExceeded):
+			res.lost++
+		case err != nil:
+			res.errors++
+		case string(reply) != "ECHO : "+msg:
+			res.mismatches++
+		default:
+			res.ok++
+			res.latencies = append(res.latencies, time.Since(start))
+		}
+	}
+	return res
+}
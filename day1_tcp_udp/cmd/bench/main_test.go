@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pixperk/bloodsport/day1_tcp_udp/tcp_echo/framing"
+	tcpserver "github.com/pixperk/bloodsport/day1_tcp_udp/tcp_echo/server"
+)
+
+func TestTCPBenchRecoversFromTimeout(t *testing.T) {
+	// the second message is answered only after the client has given up on it
+	slow := tcpserver.HandlerFunc(func(cc *tcpserver.ConnContext, msg []byte) error {
+		if string(msg) == payload(0, 1, 0) {
+			time.Sleep(300 * time.Millisecond)
+		}
+		return cc.Send(append([]byte("Echo: "), msg...))
+	})
+	s := tcpserver.NewTCPServer("localhost:0", slow)
+	go s.Start()
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	select {
+	case <-s.Ready():
+	case <-time.After(2 * time.Second):
+		t.Fatal("server did not start listening")
+	}
+
+	report, err := run(context.Background(), config{
+		proto:    "tcp",
+		addr:     s.Addr().String(),
+		clients:  1,
+		messages: 6,
+		codec:    framing.Newline,
+		timeout:  100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	if report.Sent != 6 || report.Errors != 1 || report.Mismatches != 0 || report.OK != 5 {
+		t.Errorf("Expected one timeout and five good replies, got %+v", report)
+	}
+}
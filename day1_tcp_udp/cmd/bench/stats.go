@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"time"
+)
+
+type Report struct {
+	Proto    string `json:"proto"`
+	Addr     string `json:"addr"`
+	Clients  int    `json:"clients"`
+	Messages int    `json:"messages_per_client"`
+
+	Sent       int `json:"sent"`
+	OK         int `json:"ok"`
+	Errors     int `json:"errors"`
+	Mismatches int `json:"mismatches"`
+	Lost       int `json:"lost"`
+
+	Duration   time.Duration `json:"duration_ns"`
+	Throughput float64       `json:"throughput_msgs_per_sec"`
+	ErrorRate  float64       `json:"error_rate"`
+	LossRate   float64       `json:"loss_rate"`
+
+	Latency Percentiles `json:"latency"`
+}
+
+type Percentiles struct {
+	P50 time.Duration `json:"p50_ns"`
+	P90 time.Duration `json:"p90_ns"`
+	P99 time.Duration `json:"p99_ns"`
+	Max time.Duration `json:"max_ns"`
+}
+
+// result is what one client goroutine hands back when it is done.
+type result struct {
+	sent, ok, errors, mismatches, lost int
+	latencies                          []time.Duration
+}
+
+func buildReport(r *Report, results []result, elapsed time.Duration) {
+	var latencies []time.Duration
+	for _, res := range results {
+		r.Sent += res.sent
+		r.OK += res.ok
+		r.Errors += res.errors
+		r.Mismatches += res.mismatches
+		r.Lost += res.lost
+		latencies = append(latencies, res.latencies...)
+	}
+
+	r.Duration = elapsed
+	if elapsed > 0 {
+		r.Throughput = float64(r.OK) / elapsed.Seconds()
+	}
+	if r.Sent > 0 {
+		r.ErrorRate = float64(r.Errors+r.Mismatches) / float64(r.Sent)
+		r.LossRate = float64(r.Lost) / float64(r.Sent)
+	}
+	r.Latency = percentiles(latencies)
+}
+
+// percentiles uses the nearest-rank method over the successful round trips.
+func percentiles(latencies []time.Duration) Percentiles {
+	if len(latencies) == 0 {
+		return Percentiles{}
+	}
+	slices.Sort(latencies)
+	rank := func(p float64) time.Duration {
+		i := int(p*float64(len(latencies))+0.5) - 1
+		return latencies[min(max(i, 0), len(latencies)-1)]
+	}
+	return Percentiles{
+		P50: rank(0.50),
+		P90: rank(0.90),
+		P99: rank(0.99),
+		Max: latencies[len(latencies)-1],
+	}
+}
+
+func (r *Report) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "%s bench against %s: %d clients x %d messages\n", r.Proto, r.Addr, r.Clients, r.Messages)
+	fmt.Fprintf(w, "  sent %d, ok %d, errors %d, mismatches %d, lost %d\n", r.Sent, r.OK, r.Errors, r.Mismatches, r.Lost)
+	fmt.Fprintf(w, "  duration %v, throughput %.1f msg/s\n", r.Duration.Round(time.Millisecond), r.Throughput)
+	fmt.Fprintf(w, "  error rate %.2f%%, loss rate %.2f%%\n", 100*r.ErrorRate, 100*r.LossRate)
+	fmt.Fprintf(w, "  latency p50 %v, p90 %v, p99 %v, max %v\n", r.Latency.P50, r.Latency.P90, r.Latency.P99, r.Latency.Max)
+}
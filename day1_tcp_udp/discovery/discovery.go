@@ -0,0 +1,257 @@
+// Package discovery lets servers announce themselves on an IPv4 multicast group and
+// clients find them there instead of dialing a configured address.
+//
+// Each announcement is a small JSON datagram carrying the service name, version,
+// address and current load. Browsers keep every server heard from until its
+// announcement's TTL runs out, so a server that stops announcing disappears after a
+// few missed intervals; one that shuts down cleanly withdraws itself at once.
+package discovery
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"runtime/debug"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultGroup is an administratively scoped group, so announcements stay on the
+	// local network.
+	DefaultGroup    = "239.255.77.77:7777"
+	DefaultInterval = 2 * time.Second
+)
+
+// missedAnnouncements is how many announcements in a row a server may miss before
+// browsers forget it.
+const missedAnnouncements = 3
+
+const maxAnnouncementSize = 2048
+
+type Announcement struct {
+	Service string `json:"service"`
+	Version string `json:"version,omitempty"`
+	Network string `json:"network"`
+	Addr    string `json:"addr"`
+	// Load is the server's own measure of how busy it is, such as live connections;
+	// Pick prefers the lowest.
+	Load int `json:"load"`
+	// TTL is how long the announcement stays valid. Zero withdraws the server.
+	TTL time.Duration `json:"ttl_ns"`
+}
+
+// Announcer describes how a server announces itself.
+type Announcer struct {
+	// Group is the multicast group as "ip:port"; empty means DefaultGroup.
+	Group string
+	// Interval between announcements; zero means DefaultInterval.
+	Interval time.Duration
+
+	Service string
+	// Version defaults to the main module's version from the build info.
+	Version string
+}
+
+// Run announces a server reachable over network at addr until ctx is done, then
+// withdraws it. An addr with no host, such as ":9000", is completed by browsers with
+// the address the announcement came from. load is called for every announcement.
+func (a Announcer) Run(ctx context.Context, network, addr string, load func() int) error {
+	group, err := net.ResolveUDPAddr("udp4", cmp.Or(a.Group, DefaultGroup))
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialUDP("udp4", nil, group)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	interval := cmp.Or(a.Interval, DefaultInterval)
+	version := a.Version
+	if version == "" {
+		if info, ok := debug.ReadBuildInfo(); ok {
+			version = info.Main.Version
+		}
+	}
+	send := func(ttl time.Duration) error {
+		b, err := json.Marshal(Announcement{
+			Service: a.Service,
+			Version: version,
+			Network: network,
+			Addr:    addr,
+			Load:    load(),
+			TTL:     ttl,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = conn.Write(b)
+		return err
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := send(missedAnnouncements * interval); err != nil {
+			fmt.Printf("announcing %s failed: %v\n", a.Service, err)
+		}
+		select {
+		case <-ctx.Done():
+			return send(0)
+		case <-ticker.C:
+		}
+	}
+}
+
+// Service is a server a Browser has heard from.
+type Service struct {
+	Announcement
+	LastSeen time.Time
+	expires  time.Time
+}
+
+// Browser listens for announcements and keeps track of the live servers.
+type Browser struct {
+	conn *net.UDPConn
+
+	mu       sync.Mutex
+	services map[string]*Service
+	changed  chan struct{} // closed and replaced whenever a server appears
+}
+
+// Browse joins group, or DefaultGroup when it is empty, and starts collecting
+// announcements.
+func Browse(group string) (*Browser, error) {
+	addr, err := net.ResolveUDPAddr("udp4", cmp.Or(group, DefaultGroup))
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	b := &Browser{
+		conn:     conn,
+		services: make(map[string]*Service),
+		changed:  make(chan struct{}),
+	}
+	go b.readLoop()
+	return b, nil
+}
+
+// Close leaves the group.
+func (b *Browser) Close() error {
+	return b.conn.Close()
+}
+
+func (b *Browser) readLoop() {
+	buf := make([]byte, maxAnnouncementSize)
+	for {
+		n, src, err := b.conn.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			continue
+		}
+		var a Announcement
+		if err := json.Unmarshal(buf[:n], &a); err != nil || a.Service == "" || a.Addr == "" {
+			continue
+		}
+		a.Addr = completeAddr(a.Addr, src.IP)
+		b.update(a)
+	}
+}
+
+// completeAddr fills in a missing or unspecified host with the sender's address.
+func completeAddr(addr string, from net.IP) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		return net.JoinHostPort(from.String(), port)
+	}
+	return addr
+}
+
+func (b *Browser) update(a Announcement) {
+	key := a.Service + " " + a.Network + " " + a.Addr
+	now := time.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if a.TTL <= 0 {
+		delete(b.services, key)
+		return
+	}
+	b.services[key] = &Service{Announcement: a, LastSeen: now, expires: now.Add(a.TTL)}
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// Services returns the live servers announcing service, or every live server when
+// service is empty, least loaded first.
+func (b *Browser) Services(service string) []Service {
+	now := time.Now()
+	b.mu.Lock()
+	var live []Service
+	for key, s := range b.services {
+		if now.After(s.expires) {
+			delete(b.services, key)
+			continue
+		}
+		if service == "" || s.Service == service {
+			live = append(live, *s)
+		}
+	}
+	b.mu.Unlock()
+
+	slices.SortFunc(live, func(x, y Service) int {
+		return cmp.Or(cmp.Compare(x.Load, y.Load), cmp.Compare(x.Addr, y.Addr))
+	})
+	return live
+}
+
+// Pick returns the least loaded live server announcing service, waiting for one to
+// appear until ctx is done.
+func (b *Browser) Pick(ctx context.Context, service string) (Service, error) {
+	for {
+		b.mu.Lock()
+		changed := b.changed
+		b.mu.Unlock()
+
+		if live := b.Services(service); len(live) > 0 {
+			return live[0], nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return Service{}, fmt.Errorf("no %s server found: %w", service, ctx.Err())
+		}
+	}
+}
+
+// Find browses group for one announcement interval, or DefaultInterval when interval
+// is zero, so that every live server has announced its load, and returns the least
+// loaded one announcing service. If none has been heard by then it keeps waiting for
+// the first until ctx is done.
+func Find(ctx context.Context, group, service string, interval time.Duration) (Service, error) {
+	b, err := Browse(group)
+	if err != nil {
+		return Service{}, err
+	}
+	defer b.Close()
+
+	timer := time.NewTimer(cmp.Or(interval, DefaultInterval))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return b.Pick(ctx, service)
+}
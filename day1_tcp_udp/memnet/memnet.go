@@ -0,0 +1,62 @@
+// Package memnet provides an in-memory net.Listener so servers can be exercised in
+// tests without binding real ports.
+package memnet
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+type Listener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func Listen() *Listener {
+	return &Listener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *Listener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return addr{}
+}
+
+// Dial connects to the listener, blocking until Accept picks the connection up.
+func (l *Listener) Dial(ctx context.Context) (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		client.Close()
+		server.Close()
+		return nil, &net.OpError{Op: "dial", Net: "memnet", Err: net.ErrClosed}
+	case <-ctx.Done():
+		client.Close()
+		server.Close()
+		return nil, ctx.Err()
+	}
+}
+
+type addr struct{}
+
+func (addr) Network() string { return "memnet" }
+func (addr) String() string  { return "memnet" }
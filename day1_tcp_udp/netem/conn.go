@@ -0,0 +1,119 @@
+package netem
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// PacketConn impairs the datagrams written with WriteTo. Reads pass straight through.
+type PacketConn struct {
+	net.PacketConn
+	link *link
+}
+
+// NewPacketConn wraps pc so that datagrams written to it are impaired per cfg.
+func NewPacketConn(pc net.PacketConn, cfg Config) *PacketConn {
+	return &PacketConn{
+		PacketConn: pc,
+		link:       newLink(cfg, 0, false, func(f frame) { pc.WriteTo(f.data, f.addr) }),
+	}
+}
+
+// WriteTo queues p for delivery to addr and reports it written. Send errors surface as
+// nothing more than a lost datagram, as they would on a real network.
+func (c *PacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if !c.link.send(p, addr) {
+		return 0, net.ErrClosed
+	}
+	return len(p), nil
+}
+
+// Close discards datagrams still in flight and closes the underlying connection.
+func (c *PacketConn) Close() error {
+	c.link.close(false)
+	return c.PacketConn.Close()
+}
+
+// Stats reports what has been done so far to the datagrams written to c.
+func (c *PacketConn) Stats() Stats {
+	return c.link.snapshot()
+}
+
+// Conn impairs what is written to a net.Conn. On a datagram socket, such as a
+// connected *net.UDPConn, each Write is a packet and every impairment applies. On a
+// stream the bytes arrive in order and complete, as TCP would deliver them, but may be
+// corrupted when Corrupt > 0: latency, jitter, bandwidth and corruption apply, a lost
+// write is delivered late as if retransmitted, and duplication and reordering are
+// ignored.
+type Conn struct {
+	net.Conn
+	link   *link
+	stream bool
+	err    atomic.Pointer[error]
+}
+
+// NewConn wraps c so that what is written to it is impaired per cfg.
+func NewConn(c net.Conn, cfg Config) *Conn {
+	return newConn(c, cfg, 0)
+}
+
+func newConn(c net.Conn, cfg Config, stream uint64) *Conn {
+	_, datagram := c.(net.PacketConn)
+	nc := &Conn{Conn: c, stream: !datagram}
+	nc.link = newLink(cfg, stream, nc.stream, func(f frame) {
+		if _, err := c.Write(f.data); err != nil && nc.stream {
+			nc.err.CompareAndSwap(nil, &err)
+		}
+	})
+	return nc
+}
+
+// Write queues p for delivery and reports it written. On a stream, an error from an
+// earlier delivery is returned instead, since the bytes behind it can no longer arrive.
+func (c *Conn) Write(p []byte) (int, error) {
+	if err := c.err.Load(); err != nil {
+		return 0, *err
+	}
+	if !c.link.send(p, nil) {
+		return 0, net.ErrClosed
+	}
+	return len(p), nil
+}
+
+// Close closes the underlying connection. A stream first delivers everything still in
+// flight; datagrams in flight are discarded.
+func (c *Conn) Close() error {
+	c.link.close(c.stream)
+	return c.Conn.Close()
+}
+
+// NetConn returns the wrapped connection.
+func (c *Conn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// Stats reports what has been done so far to the writes on c.
+func (c *Conn) Stats() Stats {
+	return c.link.snapshot()
+}
+
+type listener struct {
+	net.Listener
+	cfg Config
+	n   atomic.Uint64
+}
+
+// NewListener wraps every connection accepted from l with NewConn. Each connection
+// draws its random choices from its own stream, picked by accept order, so a server's
+// connections are impaired independently but still reproducibly.
+func NewListener(l net.Listener, cfg Config) net.Listener {
+	return &listener{Listener: l, cfg: cfg}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newConn(c, l.cfg, l.n.Add(1)), nil
+}
@@ -0,0 +1,328 @@
+// Package netem emulates a poor network for tests, in the spirit of Linux's netem
+// qdisc. It wraps net.PacketConn, net.Conn and net.Listener so that what is written
+// through them is lost, delayed, duplicated, reordered, corrupted or rate limited on
+// its way to the peer. Only the write side is impaired; wrap both ends to impair both
+// directions.
+package netem
+
+import (
+	"bytes"
+	"container/heap"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+)
+
+// reorderHold is how long a packet picked for reordering waits for a packet to
+// overtake it before it is sent anyway.
+const reorderHold = 10 * time.Millisecond
+
+// retransmitDelay is how long a lost segment stalls a byte stream: TCP recovers the
+// data, so loss only shows up as lateness.
+const retransmitDelay = 200 * time.Millisecond
+
+// Config describes the impairments applied to traffic written through a wrapped
+// connection. The zero Config passes everything through untouched.
+type Config struct {
+	// Seed drives every random choice. The same Seed and the same sequence of writes
+	// are impaired the same way, so a failing test can be replayed.
+	Seed uint64
+
+	// Loss drops each packet independently with this probability. Burst, when set,
+	// replaces it with bursty Gilbert-Elliott loss.
+	Loss  float64
+	Burst *GilbertElliott
+
+	// Latency delays every packet. Jitter adds a uniformly random amount in
+	// [-Jitter, Jitter] on top, never going below zero.
+	Latency time.Duration
+	Jitter  time.Duration
+
+	// Duplicate sends a second copy of a packet with this probability.
+	Duplicate float64
+	// Reorder holds a packet back with this probability and sends it right after the
+	// next one, or after 10ms if no other packet follows.
+	Reorder float64
+	// Corrupt flips one random bit of a packet with this probability.
+	Corrupt float64
+
+	// Bandwidth caps throughput at this many bytes per second, queueing packets behind
+	// each other as on a slow link. Zero means unlimited.
+	Bandwidth int
+}
+
+// GilbertElliott is a two-state bursty loss model. Before each packet the link moves
+// from the good state to the bad one with probability P, or back with probability R;
+// the packet is then lost with probability LossGood or LossBad for the current state.
+// LossGood 0 and LossBad 1 give the simple Gilbert model, whose loss bursts average
+// 1/R packets.
+type GilbertElliott struct {
+	P, R              float64
+	LossGood, LossBad float64
+}
+
+// Stats counts what a wrapped connection did to the packets written through it.
+type Stats struct {
+	Packets    uint64
+	Dropped    uint64
+	Duplicated uint64
+	Reordered  uint64
+	Corrupted  uint64
+}
+
+type frame struct {
+	data []byte
+	addr net.Addr
+	due  time.Time
+	seq  uint64
+}
+
+// frameQueue orders frames by due time, then by the order they were queued.
+type frameQueue []frame
+
+func (q frameQueue) Len() int { return len(q) }
+func (q frameQueue) Less(i, j int) bool {
+	if q[i].due.Equal(q[j].due) {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].due.Before(q[j].due)
+}
+func (q frameQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *frameQueue) Push(x any)   { *q = append(*q, x.(frame)) }
+func (q *frameQueue) Pop() any {
+	old := *q
+	f := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return f
+}
+
+// link impairs frames and hands them to deliver, one at a time and in due order, from
+// its own goroutine. A stream link keeps the byte stream intact: it never drops,
+// duplicates or reorders, and turns loss into a retransmission stall instead.
+type link struct {
+	cfg     Config
+	stream  bool
+	deliver func(frame)
+
+	mu      sync.Mutex
+	rng     *rand.Rand
+	bad     bool      // Gilbert-Elliott state
+	free    time.Time // when the bandwidth-capped link is next idle
+	lastDue time.Time
+	held    *frame
+	seq     uint64
+	queue   frameQueue
+	stats   Stats
+	closed  bool
+
+	wake    chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+func newLink(cfg Config, stream uint64, isStream bool, deliver func(frame)) *link {
+	l := &link{
+		cfg:     cfg,
+		stream:  isStream,
+		deliver: deliver,
+		rng:     rand.New(rand.NewPCG(cfg.Seed, stream)),
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+// send impairs one write. It reports false once the link is closed.
+func (l *link) send(data []byte, addr net.Addr) bool {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return false
+	}
+	l.stats.Packets++
+
+	var stall time.Duration
+	if l.lost() {
+		l.stats.Dropped++
+		if !l.stream {
+			return true
+		}
+		stall = retransmitDelay
+	}
+	copies := 1
+	if !l.stream && l.chance(l.cfg.Duplicate) {
+		l.stats.Duplicated++
+		copies = 2
+	}
+	for range copies {
+		f := frame{data: bytes.Clone(data), addr: addr, due: l.due(now, len(data), stall)}
+		if len(f.data) > 0 && l.chance(l.cfg.Corrupt) {
+			l.stats.Corrupted++
+			bit := l.rng.IntN(len(f.data) * 8)
+			f.data[bit/8] ^= 1 << (bit % 8)
+		}
+		l.push(f)
+	}
+	return true
+}
+
+func (l *link) chance(p float64) bool {
+	return p > 0 && l.rng.Float64() < p
+}
+
+// lost decides whether the next packet is dropped. l.mu must be held.
+func (l *link) lost() bool {
+	ge := l.cfg.Burst
+	if ge == nil {
+		return l.chance(l.cfg.Loss)
+	}
+	if l.bad {
+		l.bad = !l.chance(ge.R)
+	} else {
+		l.bad = l.chance(ge.P)
+	}
+	if l.bad {
+		return l.chance(ge.LossBad)
+	}
+	return l.chance(ge.LossGood)
+}
+
+// due returns when an n-byte packet written at now reaches the peer. l.mu must be held.
+func (l *link) due(now time.Time, n int, stall time.Duration) time.Time {
+	t := now
+	if bw := l.cfg.Bandwidth; bw > 0 {
+		if l.free.After(t) {
+			t = l.free
+		}
+		t = t.Add(time.Duration(n) * time.Second / time.Duration(bw))
+		l.free = t
+	}
+	delay := l.cfg.Latency + stall
+	if j := l.cfg.Jitter; j > 0 {
+		delay += time.Duration(l.rng.Int64N(2*int64(j)+1)) - j
+	}
+	t = t.Add(max(delay, 0))
+	if l.stream && t.Before(l.lastDue) {
+		t = l.lastDue
+	}
+	l.lastDue = t
+	return t
+}
+
+// push queues f, or holds it back to be overtaken. l.mu must be held.
+func (l *link) push(f frame) {
+	if !l.stream && l.held == nil && l.chance(l.cfg.Reorder) {
+		l.stats.Reordered++
+		held := &f
+		l.held = held
+		time.AfterFunc(reorderHold, func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if l.held == held && !l.closed {
+				l.held = nil
+				l.enqueue(*held)
+			}
+		})
+		return
+	}
+	l.enqueue(f)
+	if held := l.held; held != nil {
+		l.held = nil
+		if held.due.Before(f.due) {
+			held.due = f.due
+		}
+		l.enqueue(*held)
+	}
+}
+
+func (l *link) enqueue(f frame) {
+	l.seq++
+	f.seq = l.seq
+	heap.Push(&l.queue, f)
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (l *link) run() {
+	defer close(l.stopped)
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	for {
+		now := time.Now()
+		var ready []frame
+		wait := time.Duration(-1)
+		l.mu.Lock()
+		for len(l.queue) > 0 && !l.queue[0].due.After(now) {
+			ready = append(ready, heap.Pop(&l.queue).(frame))
+		}
+		if len(l.queue) > 0 {
+			wait = l.queue[0].due.Sub(now)
+		}
+		l.mu.Unlock()
+
+		for _, f := range ready {
+			l.deliver(f)
+		}
+		if len(ready) > 0 {
+			continue
+		}
+
+		var fire <-chan time.Time
+		if wait >= 0 {
+			timer.Reset(wait)
+			fire = timer.C
+		}
+		select {
+		case <-fire:
+		case <-l.wake:
+			timer.Stop()
+		case <-l.done:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// close stops the link. With flush, frames still in flight are delivered at once and
+// in order; otherwise they are discarded.
+func (l *link) close(flush bool) {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return
+	}
+	l.closed = true
+	l.mu.Unlock()
+
+	close(l.done)
+	<-l.stopped
+
+	if !flush {
+		return
+	}
+	l.mu.Lock()
+	var rest []frame
+	for len(l.queue) > 0 {
+		rest = append(rest, heap.Pop(&l.queue).(frame))
+	}
+	if l.held != nil {
+		rest = append(rest, *l.held)
+		l.held = nil
+	}
+	l.mu.Unlock()
+	for _, f := range rest {
+		l.deliver(f)
+	}
+}
+
+func (l *link) snapshot() Stats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stats
+}
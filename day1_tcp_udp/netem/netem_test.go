@@ -0,0 +1,214 @@
+package netem_test
+
+import (
+	"math/bits"
+	"net"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pixperk/bloodsport/day1_tcp_udp/netem"
+)
+
+// impairedPair returns a sender whose writes to the returned receiver pass through cfg.
+func impairedPair(t *testing.T, cfg netem.Config) (*netem.PacketConn, net.PacketConn) {
+	t.Helper()
+	rx, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { rx.Close() })
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	tx := netem.NewPacketConn(pc, cfg)
+	t.Cleanup(func() { tx.Close() })
+	return tx, rx
+}
+
+// receiveAll reads datagrams until none arrives for quiet.
+func receiveAll(rx net.PacketConn, quiet time.Duration) []string {
+	var got []string
+	buffer := make([]byte, 1024)
+	for {
+		rx.SetReadDeadline(time.Now().Add(quiet))
+		n, _, err := rx.ReadFrom(buffer)
+		if err != nil {
+			return got
+		}
+		got = append(got, string(buffer[:n]))
+	}
+}
+
+func TestNetemBurstLossIsReproducible(t *testing.T) {
+	cfg := netem.Config{Seed: 42, Burst: &netem.GilbertElliott{P: 0.1, R: 0.3, LossBad: 1}}
+
+	var runs [2][]string
+	for i := range runs {
+		tx, rx := impairedPair(t, cfg)
+		for j := range 200 {
+			tx.WriteTo([]byte(strconv.Itoa(j)), rx.LocalAddr())
+		}
+		runs[i] = receiveAll(rx, 100*time.Millisecond)
+
+		stats := tx.Stats()
+		if stats.Packets != 200 || stats.Dropped == 0 || stats.Dropped == 200 {
+			t.Fatalf("Expected some but not all of 200 packets dropped, got %+v", stats)
+		}
+		if got := uint64(len(runs[i])); got != stats.Packets-stats.Dropped {
+			t.Errorf("Expected %d packets to arrive, got %d", stats.Packets-stats.Dropped, got)
+		}
+	}
+	if !slices.Equal(runs[0], runs[1]) {
+		t.Errorf("The same seed lost different packets:\n%v\n%v", runs[0], runs[1])
+	}
+}
+
+func TestNetemSeedReproducesEveryImpairment(t *testing.T) {
+	run := func(seed uint64) ([]string, netem.Stats) {
+		tx, rx := impairedPair(t, netem.Config{Seed: seed, Loss: 0.2, Duplicate: 0.2, Reorder: 0.2, Corrupt: 0.1})
+		for j := range 200 {
+			tx.WriteTo([]byte(strconv.Itoa(j)), rx.LocalAddr())
+		}
+		return receiveAll(rx, 100*time.Millisecond), tx.Stats()
+	}
+
+	first, firstStats := run(5)
+	again, againStats := run(5)
+	if !slices.Equal(first, again) || firstStats != againStats {
+		t.Errorf("The same seed impaired the packets differently:\n%v %+v\n%v %+v", first, firstStats, again, againStats)
+	}
+	if firstStats.Dropped == 0 || firstStats.Duplicated == 0 || firstStats.Reordered == 0 || firstStats.Corrupted == 0 {
+		t.Errorf("Expected every impairment to apply to some of 200 packets, got %+v", firstStats)
+	}
+	if other, otherStats := run(6); slices.Equal(first, other) && firstStats == otherStats {
+		t.Error("A different seed impaired the packets the same way")
+	}
+}
+
+func TestNetemStatsMatchDelivery(t *testing.T) {
+	// few enough that every copy fits in the receiver's socket buffer
+	const packets = 150
+	send := func(cfg netem.Config) ([]int, netem.Stats) {
+		t.Helper()
+		tx, rx := impairedPair(t, cfg)
+		for j := range packets {
+			tx.WriteTo([]byte(strconv.Itoa(j)), rx.LocalAddr())
+		}
+		var got []int
+		for _, msg := range receiveAll(rx, 100*time.Millisecond) {
+			n, err := strconv.Atoi(msg)
+			if err != nil {
+				t.Fatalf("Unexpected packet %q", msg)
+			}
+			got = append(got, n)
+		}
+		stats := tx.Stats()
+		if stats.Packets != packets {
+			t.Fatalf("Expected %d packets counted, got %+v", packets, stats)
+		}
+		return got, stats
+	}
+
+	t.Run("loss", func(t *testing.T) {
+		got, stats := send(netem.Config{Seed: 21, Loss: 0.3})
+		if stats.Dropped == 0 || uint64(len(got)) != packets-stats.Dropped {
+			t.Errorf("Expected %d of %d packets to arrive, got %d", packets-stats.Dropped, packets, len(got))
+		}
+	})
+
+	t.Run("duplication", func(t *testing.T) {
+		got, stats := send(netem.Config{Seed: 22, Duplicate: 0.3})
+		seen := make(map[int]int)
+		var twice uint64
+		for _, n := range got {
+			if seen[n]++; seen[n] == 2 {
+				twice++
+			}
+		}
+		if stats.Duplicated == 0 || twice != stats.Duplicated || uint64(len(got)) != packets+stats.Duplicated {
+			t.Errorf("Expected %d packets to arrive twice, got %d of %d arrivals", stats.Duplicated, twice, len(got))
+		}
+	})
+
+	t.Run("reordering", func(t *testing.T) {
+		got, stats := send(netem.Config{Seed: 23, Reorder: 0.3})
+		// a held packet arrives right after the one that overtook it
+		var late uint64
+		for i := 1; i < len(got); i++ {
+			if got[i] < got[i-1] {
+				late++
+			}
+		}
+		if len(got) != packets || stats.Reordered == 0 || late != stats.Reordered {
+			t.Errorf("Expected %d of %d packets overtaken, got %d of %d", stats.Reordered, packets, late, len(got))
+		}
+	})
+}
+
+func TestNetemImpairments(t *testing.T) {
+	t.Run("latency", func(t *testing.T) {
+		tx, rx := impairedPair(t, netem.Config{Latency: 50 * time.Millisecond, Jitter: 10 * time.Millisecond})
+		start := time.Now()
+		tx.WriteTo([]byte("late"), rx.LocalAddr())
+		got := receiveAll(rx, 200*time.Millisecond)
+		if len(got) != 1 {
+			t.Fatalf("Expected 1 packet, got %v", got)
+		}
+		if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+			t.Errorf("Expected at least 40ms of delay, packet took %v", elapsed)
+		}
+	})
+
+	t.Run("duplication", func(t *testing.T) {
+		tx, rx := impairedPair(t, netem.Config{Duplicate: 1})
+		tx.WriteTo([]byte("twice"), rx.LocalAddr())
+		if got := receiveAll(rx, 100*time.Millisecond); !slices.Equal(got, []string{"twice", "twice"}) {
+			t.Errorf("Expected two copies, got %v", got)
+		}
+	})
+
+	t.Run("reordering", func(t *testing.T) {
+		tx, rx := impairedPair(t, netem.Config{Reorder: 1})
+		for _, msg := range []string{"a", "b", "c", "d"} {
+			tx.WriteTo([]byte(msg), rx.LocalAddr())
+		}
+		if got := receiveAll(rx, 100*time.Millisecond); !slices.Equal(got, []string{"b", "a", "d", "c"}) {
+			t.Errorf("Expected every other packet to be overtaken, got %v", got)
+		}
+	})
+
+	t.Run("corruption", func(t *testing.T) {
+		tx, rx := impairedPair(t, netem.Config{Corrupt: 1})
+		sent := "corrupt me"
+		tx.WriteTo([]byte(sent), rx.LocalAddr())
+		got := receiveAll(rx, 100*time.Millisecond)
+		if len(got) != 1 {
+			t.Fatalf("Expected 1 packet, got %v", got)
+		}
+		flipped := 0
+		for i := range sent {
+			flipped += bits.OnesCount8(sent[i] ^ got[0][i])
+		}
+		if flipped != 1 {
+			t.Errorf("Expected exactly one flipped bit, got %d", flipped)
+		}
+	})
+
+	t.Run("bandwidth", func(t *testing.T) {
+		tx, rx := impairedPair(t, netem.Config{Bandwidth: 10_000})
+		start := time.Now()
+		for range 5 {
+			tx.WriteTo(make([]byte, 500), rx.LocalAddr())
+		}
+		if got := receiveAll(rx, 100*time.Millisecond); len(got) != 5 {
+			t.Fatalf("Expected 5 packets, got %d", len(got))
+		}
+		// 2500 bytes at 10KB/s, less the quiet period spent waiting for a sixth
+		if elapsed := time.Since(start) - 100*time.Millisecond; elapsed < 200*time.Millisecond {
+			t.Errorf("Expected the link to take about 250ms, took %v", elapsed)
+		}
+	})
+}
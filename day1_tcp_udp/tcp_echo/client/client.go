@@ -2,27 +2,127 @@ package client
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/pixperk/bloodsport/day1_tcp_udp/tcp_echo/framing"
+)
+
+var (
+	ErrNotConnected = errors.New("not connected to server")
+	errConnLost     = errors.New("connection lost")
+	// ErrPipelined is returned by ReadLine when a background reader owns the connection.
+	ErrPipelined = errors.New("ReadLine is unavailable in pipelined mode, use RoundTrip")
 )
 
+type Option func(*TCPClient)
+
+// WithTimeout sets the dial timeout and the per-operation read/write deadline.
+func WithTimeout(d time.Duration) Option {
+	return func(c *TCPClient) {
+		c.timeout = d
+	}
+}
+
+// WithPipelining lets many RoundTrip calls be in flight at once. A background reader
+// matches replies to callers in the order their requests were written.
+func WithPipelining() Option {
+	return func(c *TCPClient) {
+		c.pipelined = true
+	}
+}
+
+// WithTLS dials the server over TLS with cfg. Set cfg.Certificates for mutual TLS.
+func WithTLS(cfg *tls.Config) Option {
+	return func(c *TCPClient) {
+		c.tlsConfig = cfg
+	}
+}
+
+// WithDialer replaces the network dial, e.g. with an in-memory pipe in tests. SrvAddr
+// is then only used as the TLS server name.
+func WithDialer(dial func(ctx context.Context) (net.Conn, error)) Option {
+	return func(c *TCPClient) {
+		c.dialer = dial
+	}
+}
+
+// WithCodec frames messages with codec instead of newline-delimited lines. It must
+// match the server's codec.
+func WithCodec(codec framing.Codec) Option {
+	return func(c *TCPClient) {
+		c.codec = codec
+	}
+}
+
+// WithMaxFrameSize caps the size of a frame read from the server, 64KiB by default.
+func WithMaxFrameSize(n int) Option {
+	return func(c *TCPClient) {
+		if n > 0 {
+			c.maxFrame = n
+		}
+	}
+}
+
+// WithReconnect re-dials SrvAddr in the background whenever the connection is lost.
+// Operations started while reconnecting wait up to the client timeout for it to finish,
+// and a RoundTrip that loses its connection is retried once on the new one.
+func WithReconnect(p ReconnectPolicy) Option {
+	return func(c *TCPClient) {
+		p.setDefaults()
+		c.reconnect = &p
+	}
+}
+
 type TCPClient struct {
 	SrvAddr   string
 	conn      net.Conn
 	reader    *bufio.Reader
 	timeout   time.Duration
+	pipelined bool
+	tlsConfig *tls.Config
+	dialer    func(ctx context.Context) (net.Conn, error)
+	codec     framing.Codec
+	maxFrame  int
 	mu        sync.Mutex
 	connected bool
+
+	reconnect    *ReconnectPolicy
+	reconnecting chan struct{} // closed when the current reconnect attempt loop ends
+	closed       chan struct{} // closed by Close to stop reconnecting
+	states       chan ConnState
+
+	wmu sync.Mutex // serializes writes, and in pipelined mode the pending queue order
+	rmu sync.Mutex // serializes non-pipelined round trips
+
+	pmu      sync.Mutex
+	pending  []chan frameResult
+	readDone chan struct{}
+}
+
+type frameResult struct {
+	frame []byte
+	err   error
 }
 
-func NewTCPClient(addr string) *TCPClient {
-	return &TCPClient{
-		SrvAddr: addr,
-		timeout: 30 * time.Second,
+func NewTCPClient(addr string, opts ...Option) *TCPClient {
+	c := &TCPClient{
+		SrvAddr:  addr,
+		timeout:  30 * time.Second,
+		codec:    framing.Newline,
+		maxFrame: 64 * 1024,
+		states:   make(chan ConnState, 16),
+	}
+	for _, opt := range opts {
+		opt(c)
 	}
+	return c
 }
 
 func (c *TCPClient) Connect() error {
@@ -31,42 +131,349 @@ func (c *TCPClient) Connect() error {
 	if c.connected {
 		return nil
 	}
-	conn, err := net.DialTimeout("tcp", c.SrvAddr, c.timeout)
+	conn, err := c.dial()
 	if err != nil {
 		return fmt.Errorf("failed to connect to server: %w", err)
 	}
+	c.closed = make(chan struct{})
+	c.setConn(conn)
+
+	return nil
+}
+
+func (c *TCPClient) dial() (net.Conn, error) {
+	ctx := context.Background()
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	var conn net.Conn
+	var err error
+	if c.dialer != nil {
+		conn, err = c.dialer(ctx)
+	} else {
+		network, address := "tcp", c.SrvAddr
+		if path, ok := strings.CutPrefix(c.SrvAddr, "unix://"); ok {
+			network, address = "unix", path
+		}
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, network, address)
+	}
+	if err != nil || c.tlsConfig == nil {
+		return conn, err
+	}
+
+	cfg := c.tlsConfig
+	if cfg.ServerName == "" && !cfg.InsecureSkipVerify {
+		if host, _, err := net.SplitHostPort(c.SrvAddr); err == nil {
+			cfg = cfg.Clone()
+			cfg.ServerName = host
+		}
+	}
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// setConn installs a freshly dialled conn. c.mu must be held.
+func (c *TCPClient) setConn(conn net.Conn) {
 	c.conn = conn
 	c.reader = bufio.NewReader(conn)
 	c.connected = true
 
-	return nil
+	if c.pipelined {
+		c.readDone = make(chan struct{})
+		go c.readLoop(conn, c.reader, c.readDone)
+	}
+	c.emitState(StateConnected)
 }
 
-func (c *TCPClient) SendLine(line string) error {
+// current returns the live connection, waiting for an in-progress reconnect if needed.
+func (c *TCPClient) current() (net.Conn, *bufio.Reader, error) {
+	c.mu.Lock()
+	if c.connected {
+		defer c.mu.Unlock()
+		return c.conn, c.reader, nil
+	}
+	waiting := c.reconnecting
+	c.mu.Unlock()
+
+	if waiting == nil {
+		return nil, nil, ErrNotConnected
+	}
+
+	var timeout <-chan time.Time
+	if c.timeout > 0 {
+		timer := time.NewTimer(c.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-waiting:
+	case <-timeout:
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	if !c.connected {
-		return fmt.Errorf("not connected to server")
+		return nil, nil, ErrNotConnected
 	}
+	return c.conn, c.reader, nil
+}
+
+// SendLine sends line as one frame; a trailing newline is not part of the frame.
+func (c *TCPClient) SendLine(line string) error {
+	return c.SendFrame([]byte(strings.TrimSuffix(line, "\n")))
+}
 
-	if !strings.HasSuffix(line, "\n") {
-		line += "\n"
+func (c *TCPClient) SendFrame(payload []byte) error {
+	frame, err := c.codec.AppendFrame(nil, payload)
+	if err != nil {
+		return err
+	}
+
+	conn, _, err := c.current()
+	if err != nil {
+		return err
 	}
 
-	_, err := c.conn.Write([]byte(line))
+	c.wmu.Lock()
+	err = c.write(conn, frame)
+	c.wmu.Unlock()
+	if err == nil || !c.connLost(conn, err) {
+		return err
+	}
+
+	if conn, _, err = c.current(); err != nil {
+		return err
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.write(conn, frame)
+}
+
+func (c *TCPClient) write(conn net.Conn, frame []byte) error {
+	if c.timeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	}
+	_, err := conn.Write(frame)
 	return err
 }
 
+// ReadLine reads the next frame from the server, a line without its trailing newline
+// with the default codec.
+func (c *TCPClient) ReadLine() (string, error) {
+	frame, err := c.ReadFrame()
+	return string(frame), err
+}
+
+func (c *TCPClient) ReadFrame() ([]byte, error) {
+	if c.pipelined {
+		return nil, ErrPipelined
+	}
+	conn, reader, err := c.current()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(c.timeout))
+	}
+	frame, err := c.codec.ReadFrame(reader, c.maxFrame)
+	if err != nil {
+		c.connLost(conn, err)
+	}
+	return frame, err
+}
+
+// RoundTrip sends line and waits for the matching reply. It gives up when ctx is done
+// or the client timeout elapses, whichever comes first. Giving up once the request may
+// have gone out closes the connection, as its reply would otherwise be taken for the
+// next request's; WithReconnect dials a new one.
+//
+// With WithReconnect, a request whose connection is lost before its reply arrives is
+// sent once more on the new connection. The server may then handle it twice, so only
+// use RoundTrip for requests that are safe to repeat.
+func (c *TCPClient) RoundTrip(ctx context.Context, line string) (string, error) {
+	reply, err := c.RoundTripFrame(ctx, []byte(strings.TrimSuffix(line, "\n")))
+	return string(reply), err
+}
+
+// RoundTripFrame is RoundTrip for arbitrary payloads.
+func (c *TCPClient) RoundTripFrame(ctx context.Context, payload []byte) ([]byte, error) {
+	frame, err := c.codec.AppendFrame(nil, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	roundTrip := c.roundTrip
+	if c.pipelined {
+		roundTrip = c.pipelinedRoundTrip
+	}
+
+	reply, err := roundTrip(ctx, frame)
+	if errors.Is(err, errConnLost) && c.reconnect != nil && ctx.Err() == nil {
+		return roundTrip(ctx, frame)
+	}
+	return reply, err
+}
+
+func (c *TCPClient) roundTrip(ctx context.Context, frame []byte) ([]byte, error) {
+	conn, reader, err := c.current()
+	if err != nil {
+		return nil, err
+	}
+
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	deadline := time.Time{}
+	if c.timeout > 0 {
+		deadline = time.Now().Add(c.timeout)
+	}
+	if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	defer conn.SetDeadline(time.Time{})
+
+	// unblock the read/write below as soon as ctx is cancelled
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	c.wmu.Lock()
+	_, err = conn.Write(frame)
+	c.wmu.Unlock()
+	if err == nil {
+		var reply []byte
+		reply, err = c.codec.ReadFrame(reader, c.maxFrame)
+		if err == nil {
+			return reply, nil
+		}
+	}
+	// even after a timeout, part of the request or its reply may still be in transit
+	c.abandon(conn)
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	// the socket deadline may fire a hair before ctx notices its own
+	if d, ok := ctx.Deadline(); ok && !time.Now().Before(d) {
+		return nil, context.DeadlineExceeded
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return nil, err
+	}
+	return nil, fmt.Errorf("%w: %w", errConnLost, err)
+}
+
+func (c *TCPClient) pipelinedRoundTrip(ctx context.Context, frame []byte) ([]byte, error) {
+	conn, _, err := c.current()
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan frameResult, 1)
+
+	c.wmu.Lock()
+	c.pmu.Lock()
+	c.pending = append(c.pending, ch)
+	c.pmu.Unlock()
+	err = c.write(conn, frame)
+	c.wmu.Unlock()
+
+	if err != nil {
+		// the queue no longer lines up with what the server saw
+		c.connLost(conn, err)
+		conn.Close()
+		return nil, fmt.Errorf("%w: %w", errConnLost, err)
+	}
+
+	var timeout <-chan time.Time
+	if c.timeout > 0 {
+		timer := time.NewTimer(c.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case res := <-ch:
+		return res.frame, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timeout:
+		return nil, fmt.Errorf("round trip timed out after %v", c.timeout)
+	}
+}
+
+// readLoop delivers each reply to the oldest waiting caller. Callers that gave up still
+// own their slot, so later replies keep lining up with later requests.
+func (c *TCPClient) readLoop(conn net.Conn, reader *bufio.Reader, done chan struct{}) {
+	defer close(done)
+	for {
+		frame, err := c.codec.ReadFrame(reader, c.maxFrame)
+		if err != nil {
+			c.failPending(fmt.Errorf("%w: %w", errConnLost, err))
+			c.connLost(conn, err)
+			conn.Close()
+			return
+		}
+
+		c.pmu.Lock()
+		if len(c.pending) == 0 {
+			c.pmu.Unlock()
+			fmt.Printf("dropping unsolicited reply: %q\n", frame)
+			continue
+		}
+		ch := c.pending[0]
+		c.pending = c.pending[1:]
+		c.pmu.Unlock()
+
+		ch <- frameResult{frame: frame}
+	}
+}
+
+func (c *TCPClient) failPending(err error) {
+	c.pmu.Lock()
+	defer c.pmu.Unlock()
+	for _, ch := range c.pending {
+		ch <- frameResult{err: err}
+	}
+	c.pending = nil
+}
+
 func (c *TCPClient) Close() error {
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	if c.closed != nil {
+		close(c.closed)
+		c.closed = nil
+	}
 	if !c.connected {
-		return fmt.Errorf("not connected to server")
+		c.mu.Unlock()
+		return ErrNotConnected
 	}
 	err := c.conn.Close()
-	if err != nil {
-		return fmt.Errorf("failed to close connection: %w", err)
-	}
 	c.connected = false
 	c.conn = nil
 	c.reader = nil
+	readDone := c.readDone
+	c.readDone = nil
+	c.emitState(StateDisconnected)
+	c.mu.Unlock()
+
+	if readDone != nil {
+		<-readDone
+	}
+	if err != nil {
+		return fmt.Errorf("failed to close connection: %w", err)
+	}
 	return nil
 }
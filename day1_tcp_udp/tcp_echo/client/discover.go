@@ -0,0 +1,19 @@
+package client
+
+import (
+	"context"
+	"time"
+
+	"github.com/pixperk/bloodsport/day1_tcp_udp/discovery"
+)
+
+// Discover listens on the multicast group, or discovery.DefaultGroup when group is
+// empty, for the servers' announcement interval and returns an unconnected client for
+// the least loaded server announcing service; see discovery.Find.
+func Discover(ctx context.Context, group, service string, interval time.Duration, opts ...Option) (*TCPClient, error) {
+	s, err := discovery.Find(ctx, group, service, interval)
+	if err != nil {
+		return nil, err
+	}
+	return NewTCPClient(s.Addr, opts...), nil
+}
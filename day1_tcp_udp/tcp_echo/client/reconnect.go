@@ -0,0 +1,168 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"time"
+)
+
+type ConnState int
+
+const (
+	StateDisconnected ConnState = iota
+	StateReconnecting
+	StateConnected
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateDisconnected:
+		return "disconnected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateConnected:
+		return "connected"
+	default:
+		return fmt.Sprintf("ConnState(%d)", int(s))
+	}
+}
+
+type ReconnectPolicy struct {
+	InitialBackoff time.Duration // delay before the second attempt, default 100ms
+	MaxBackoff     time.Duration // cap on the delay between attempts, default 10s
+	Multiplier     float64       // backoff growth per failed attempt, default 2
+	Jitter         float64       // fraction of each delay that is randomised, default 0.2; negative for none
+	MaxAttempts    int           // 0 retries forever
+
+	// OnReconnect is called after a successful re-dial with the attempt that succeeded.
+	OnReconnect func(attempt int)
+}
+
+func (p *ReconnectPolicy) setDefaults() {
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = 100 * time.Millisecond
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = 10 * time.Second
+	}
+	if p.Multiplier < 1 {
+		p.Multiplier = 2
+	}
+	if p.Jitter == 0 {
+		p.Jitter = 0.2
+	} else if p.Jitter < 0 {
+		p.Jitter = 0
+	}
+}
+
+func (p *ReconnectPolicy) delay(backoff time.Duration) time.Duration {
+	spread := p.Jitter * (2*rand.Float64() - 1)
+	return time.Duration(float64(backoff) * (1 + spread))
+}
+
+// States reports connection state transitions. The channel is buffered; if the caller
+// falls behind, the oldest transitions are dropped so the latest one is always delivered.
+func (c *TCPClient) States() <-chan ConnState {
+	return c.states
+}
+
+// emitState publishes s without blocking. c.mu must be held.
+func (c *TCPClient) emitState(s ConnState) {
+	for {
+		select {
+		case c.states <- s:
+			return
+		default:
+		}
+		select {
+		case <-c.states:
+		default:
+		}
+	}
+}
+
+// connLost reports whether err means conn is unusable. The first caller to see conn die
+// marks the client disconnected and, with a reconnect policy, starts re-dialling.
+func (c *TCPClient) connLost(conn net.Conn, err error) bool {
+	var ne net.Error
+	if err == nil || (errors.As(err, &ne) && ne.Timeout()) {
+		return false
+	}
+	c.abandon(conn)
+	return true
+}
+
+// abandon closes conn and handles it as lost, whatever state it was left in.
+func (c *TCPClient) abandon(conn net.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != conn || !c.connected {
+		return
+	}
+
+	c.connected = false
+	conn.Close()
+	c.emitState(StateDisconnected)
+
+	if c.reconnect != nil && c.closed != nil && c.reconnecting == nil {
+		c.reconnecting = make(chan struct{})
+		c.emitState(StateReconnecting)
+		go c.reconnectLoop(c.closed, c.reconnecting)
+	}
+}
+
+func (c *TCPClient) reconnectLoop(closed, done chan struct{}) {
+	defer close(done)
+
+	p := c.reconnect
+	backoff := p.InitialBackoff
+	for attempt := 1; p.MaxAttempts == 0 || attempt <= p.MaxAttempts; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-closed:
+				c.finishReconnect()
+				return
+			case <-time.After(p.delay(backoff)):
+			}
+			backoff = min(time.Duration(float64(backoff)*p.Multiplier), p.MaxBackoff)
+		}
+
+		conn, err := c.dial()
+		if err != nil {
+			fmt.Printf("reconnect attempt %d failed: %v\n", attempt, err)
+			continue
+		}
+
+		c.mu.Lock()
+		select {
+		case <-closed:
+			c.reconnecting = nil
+			c.mu.Unlock()
+			conn.Close()
+			return
+		default:
+		}
+		c.reconnecting = nil
+		c.setConn(conn)
+		c.mu.Unlock()
+
+		if p.OnReconnect != nil {
+			p.OnReconnect(attempt)
+		}
+		return
+	}
+
+	fmt.Printf("giving up reconnecting to %s after %d attempts\n", c.SrvAddr, p.MaxAttempts)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reconnecting = nil
+	c.emitState(StateDisconnected)
+}
+
+func (c *TCPClient) finishReconnect() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reconnecting = nil
+}
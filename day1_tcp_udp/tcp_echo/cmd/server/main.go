@@ -0,0 +1,148 @@
+// Command server runs the TCP echo server. SIGINT and SIGTERM shut it down gracefully;
+// SIGHUP and SIGUSR2 hand its listening sockets to a freshly started copy of the
+// binary and drain the existing connections before exiting.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pixperk/bloodsport/day1_tcp_udp/admin"
+	"github.com/pixperk/bloodsport/day1_tcp_udp/discovery"
+	"github.com/pixperk/bloodsport/day1_tcp_udp/tcp_echo/framing"
+	"github.com/pixperk/bloodsport/day1_tcp_udp/tcp_echo/server"
+	"github.com/pixperk/bloodsport/day1_tcp_udp/tlsutil"
+	"github.com/pixperk/bloodsport/day1_tcp_udp/upgrade"
+)
+
+func main() {
+	addr := flag.String("addr", ":9000", `listen address, or "unix:///path" for a Unix socket`)
+	codecName := flag.String("codec", "newline", "framing: newline, uvarint or u32be")
+	pubsub := flag.Bool("pubsub", false, "serve SUB/UNSUB/PUB commands instead of echoing")
+	proxyProtocol := flag.Bool("proxy-protocol", false, "read PROXY protocol headers from every peer")
+	certFile := flag.String("cert", "", "TLS certificate file")
+	keyFile := flag.String("key", "", "TLS key file")
+	selfSigned := flag.Bool("self-signed", false, "serve TLS with a generated certificate")
+	clientCA := flag.String("client-ca", "", "CA bundle used to verify client certificates")
+	adminAddr := flag.String("admin", "", "serve the admin HTTP API on this loopback address, e.g. localhost:9100")
+	eventLoops := flag.Int("event-loops", -1, "serve connections from this many epoll loops instead of a goroutine each; 0 means one per CPU (Linux only)")
+	announceGroup := flag.String("announce", "", "announce the server on this multicast group for discovery, e.g. "+discovery.DefaultGroup)
+	tcpInfoInterval := flag.Duration("tcp-info-interval", 0, "sample TCP_INFO for every connection this often, e.g. 10s (Linux only)")
+	drainTimeout := flag.Duration("drain-timeout", 30*time.Second, "how long to drain connections on shutdown or upgrade")
+	flag.Parse()
+
+	codec, err := framing.ByName(*codecName)
+	if err != nil {
+		fail(err)
+	}
+	opts := []server.Option{server.WithCodec(codec)}
+	if *certFile != "" || *selfSigned {
+		tlsConfig, err := tlsutil.ServerConfig{
+			CertFile:     *certFile,
+			KeyFile:      *keyFile,
+			SelfSigned:   *selfSigned,
+			ClientCAFile: *clientCA,
+		}.Build()
+		if err != nil {
+			fail(fmt.Errorf("TLS setup failed: %w", err))
+		}
+		opts = append(opts, server.WithTLS(tlsConfig))
+	}
+	if *proxyProtocol {
+		opts = append(opts, server.WithProxyProtocol(true))
+	}
+	if *eventLoops >= 0 {
+		opts = append(opts, server.WithEventLoop(*eventLoops))
+	}
+	if *tcpInfoInterval > 0 {
+		opts = append(opts, server.WithTCPInfoInterval(*tcpInfoInterval))
+	}
+	if *announceGroup != "" {
+		opts = append(opts, server.WithAnnouncer(discovery.Announcer{Group: *announceGroup, Service: "tcp-echo"}))
+	}
+
+	var handler server.Handler = server.EchoHandler()
+	if *pubsub {
+		handler = server.NewPubSub(0, server.DropOldest)
+	}
+	srv := server.NewTCPServer(*addr, handler, opts...)
+
+	// listeners are taken in the same order they are handed to upgrade.Upgrade below
+	network, address := "tcp", *addr
+	if path, ok := strings.CutPrefix(*addr, "unix://"); ok {
+		network, address = "unix", path
+	}
+	lis, err := upgrade.Listen(network, address)
+	if err != nil {
+		fail(err)
+	}
+	listeners := []net.Listener{lis}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if *adminAddr != "" {
+		adminLis, err := upgrade.Listen("tcp", *adminAddr)
+		if err != nil {
+			fail(err)
+		}
+		listeners = append(listeners, adminLis)
+		go func() {
+			if err := admin.ServeListener(ctx, adminLis, map[string]admin.Target{"tcp": admin.TCP(srv)}); err != nil {
+				fmt.Printf("admin server error: %v\n", err)
+			}
+		}()
+	}
+
+	errs := make(chan error, 1)
+	go func() { errs <- srv.Serve(context.Background(), lis) }()
+	<-srv.Ready()
+	if err := upgrade.Ready(); err != nil {
+		fmt.Printf("failed to notify parent: %v\n", err)
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, append([]os.Signal{syscall.SIGINT, syscall.SIGTERM}, upgradeSignals...)...)
+	for {
+		select {
+		case err := <-errs:
+			if err != nil {
+				fail(err)
+			}
+			return
+		case sig := <-sigs:
+			if slices.Contains(upgradeSignals, sig) {
+				child, err := upgrade.Upgrade(listeners...)
+				if err != nil {
+					fmt.Printf("upgrade failed, still serving: %v\n", err)
+					continue
+				}
+				fmt.Printf("handed listeners to pid %d, draining\n", child.Pid)
+				// the child serves the admin API now; stop answering on our copy of its listener
+				cancel()
+			} else {
+				fmt.Println("\nShutdown signal received...")
+			}
+
+			drainCtx, drainCancel := context.WithTimeout(context.Background(), *drainTimeout)
+			if err := srv.Shutdown(drainCtx); err != nil {
+				fmt.Printf("drain incomplete: %v\n", err)
+			}
+			drainCancel()
+			return
+		}
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "server: %v\n", err)
+	os.Exit(1)
+}
@@ -0,0 +1,11 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// upgradeSignals hand the listeners to a new process instead of just shutting down.
+var upgradeSignals = []os.Signal{syscall.SIGHUP, syscall.SIGUSR2}
@@ -0,0 +1,192 @@
+// Package framing splits a byte stream into messages for TCPServer and TCPClient.
+package framing
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+var ErrFrameTooLarge error = sizeError("frame too large")
+
+// ErrLineTooLong is the Newline codec's ErrFrameTooLarge; errors.Is matches both.
+var ErrLineTooLong error = sizeError("line too long")
+
+type sizeError string
+
+func (e sizeError) Error() string {
+	return string(e)
+}
+
+func (e sizeError) Is(target error) bool {
+	return target == ErrFrameTooLarge
+}
+
+type Codec interface {
+	Name() string
+
+	// ReadFrame reads the next frame's payload, failing with ErrFrameTooLarge before
+	// buffering more than max payload bytes. The returned slice belongs to the caller.
+	ReadFrame(r *bufio.Reader, max int) ([]byte, error)
+
+	// AppendFrame appends the framed encoding of payload to dst.
+	AppendFrame(dst, payload []byte) ([]byte, error)
+
+	// Split extracts the first complete frame from data, for callers that read into
+	// their own buffers. It returns the payload, which aliases data, and the number of
+	// bytes the frame occupied; n is 0 when data holds no complete frame yet. Like
+	// ReadFrame it fails with ErrFrameTooLarge once the frame is known to exceed max.
+	Split(data []byte, max int) (payload []byte, n int, err error)
+}
+
+var (
+	// Newline frames are lines terminated by "\n"; a trailing "\r" is stripped on read.
+	Newline Codec = newline{}
+
+	// Uvarint frames are prefixed with their length as an unsigned varint.
+	Uvarint Codec = uvarint{}
+
+	// Uint32BE frames are prefixed with their length as a 4-byte big-endian integer.
+	Uint32BE Codec = uint32BE{}
+)
+
+// ByName returns the codec called name, as reported by its Name method.
+func ByName(name string) (Codec, error) {
+	for _, c := range []Codec{Newline, Uvarint, Uint32BE} {
+		if c.Name() == name {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("framing: unknown codec %q", name)
+}
+
+type newline struct{}
+
+func (newline) Name() string { return "newline" }
+
+func (newline) ReadFrame(r *bufio.Reader, max int) ([]byte, error) {
+	var line []byte
+	for {
+		frag, err := r.ReadSlice('\n')
+		if len(line)+len(bytes.TrimRight(frag, "\r\n")) > max {
+			return nil, ErrLineTooLong
+		}
+		line = append(line, frag...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return bytes.TrimRight(line, "\r\n"), nil
+	}
+}
+
+func (newline) Split(data []byte, max int) ([]byte, int, error) {
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		// allow for a "\r" that will be trimmed once the newline arrives
+		if len(bytes.TrimRight(data, "\r")) > max {
+			return nil, 0, ErrLineTooLong
+		}
+		return nil, 0, nil
+	}
+	line := bytes.TrimRight(data[:i], "\r")
+	if len(line) > max {
+		return nil, 0, ErrLineTooLong
+	}
+	return line, i + 1, nil
+}
+
+func (newline) AppendFrame(dst, payload []byte) ([]byte, error) {
+	if bytes.IndexByte(payload, '\n') >= 0 {
+		return dst, errors.New("framing: newline frame contains a newline")
+	}
+	dst = append(dst, payload...)
+	return append(dst, '\n'), nil
+}
+
+type uvarint struct{}
+
+func (uvarint) Name() string { return "uvarint" }
+
+func (uvarint) ReadFrame(r *bufio.Reader, max int) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	return readPayload(r, n, max)
+}
+
+func (uvarint) Split(data []byte, max int) ([]byte, int, error) {
+	size, n := binary.Uvarint(data)
+	if n == 0 {
+		return nil, 0, nil
+	}
+	if n < 0 {
+		return nil, 0, errors.New("framing: uvarint length overflows 64 bits")
+	}
+	return splitPayload(data, n, size, max)
+}
+
+func (uvarint) AppendFrame(dst, payload []byte) ([]byte, error) {
+	dst = binary.AppendUvarint(dst, uint64(len(payload)))
+	return append(dst, payload...), nil
+}
+
+type uint32BE struct{}
+
+func (uint32BE) Name() string { return "u32be" }
+
+func (uint32BE) ReadFrame(r *bufio.Reader, max int) ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	return readPayload(r, uint64(binary.BigEndian.Uint32(hdr[:])), max)
+}
+
+func (uint32BE) Split(data []byte, max int) ([]byte, int, error) {
+	if len(data) < 4 {
+		return nil, 0, nil
+	}
+	return splitPayload(data, 4, uint64(binary.BigEndian.Uint32(data)), max)
+}
+
+func (uint32BE) AppendFrame(dst, payload []byte) ([]byte, error) {
+	if uint64(len(payload)) > math.MaxUint32 {
+		return dst, ErrFrameTooLarge
+	}
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(payload)))
+	return append(dst, payload...), nil
+}
+
+// splitPayload returns the size-byte payload that follows a hdr-byte length prefix.
+func splitPayload(data []byte, hdr int, size uint64, max int) ([]byte, int, error) {
+	if size > uint64(max) {
+		return nil, 0, ErrFrameTooLarge
+	}
+	end := hdr + int(size)
+	if len(data) < end {
+		return nil, 0, nil
+	}
+	return data[hdr:end], end, nil
+}
+
+func readPayload(r *bufio.Reader, n uint64, max int) ([]byte, error) {
+	if n > uint64(max) {
+		return nil, ErrFrameTooLarge
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return payload, nil
+}
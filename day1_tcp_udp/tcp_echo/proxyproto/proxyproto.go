@@ -0,0 +1,258 @@
+// Package proxyproto parses HAProxy PROXY protocol v1 (text) and v2 (binary) headers,
+// which load balancers prepend to a connection to pass on the client's real address.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrNoHeader is returned by Read when the stream does not start with a PROXY header.
+	ErrNoHeader = errors.New("proxyproto: no PROXY header")
+
+	ErrInvalidHeader = errors.New("proxyproto: invalid PROXY header")
+)
+
+var (
+	v1Prefix    = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// v1MaxLen is the longest legal v1 header including its CRLF.
+const v1MaxLen = 107
+
+type Header struct {
+	Version int
+
+	// Local is set for v2 LOCAL and v1 UNKNOWN headers, which a proxy sends for its own
+	// health checks; Source and Destination are nil and the real addresses apply.
+	Local bool
+
+	Source      net.Addr
+	Destination net.Addr
+}
+
+// Read consumes a PROXY header from the front of r. If the stream does not begin with
+// one it returns ErrNoHeader and consumes nothing.
+func Read(r *bufio.Reader) (*Header, error) {
+	switch {
+	case hasPrefix(r, v2Signature):
+		return readV2(r)
+	case hasPrefix(r, v1Prefix):
+		return readV1(r)
+	default:
+		return nil, ErrNoHeader
+	}
+}
+
+// hasPrefix peeks one byte at a time so that a short non-PROXY message is never waited
+// on beyond its first byte that differs from the signature.
+func hasPrefix(r *bufio.Reader, prefix []byte) bool {
+	for i := 1; i <= len(prefix); i++ {
+		peek, err := r.Peek(i)
+		if err != nil || peek[i-1] != prefix[i-1] {
+			return false
+		}
+	}
+	return true
+}
+
+func readV1(r *bufio.Reader) (*Header, error) {
+	var line []byte
+	for len(line) < v1MaxLen {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("%w: v1 header not terminated by CRLF", ErrInvalidHeader)
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return &Header{Version: 1, Local: true}, nil
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("%w: v1 header has %d fields", ErrInvalidHeader, len(fields))
+	}
+
+	src, err := v1Addr(fields[1], fields[2], fields[4])
+	if err != nil {
+		return nil, err
+	}
+	dst, err := v1Addr(fields[1], fields[3], fields[5])
+	if err != nil {
+		return nil, err
+	}
+	return &Header{Version: 1, Source: src, Destination: dst}, nil
+}
+
+func v1Addr(proto, host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("%w: bad address %q", ErrInvalidHeader, host)
+	}
+	if (proto == "TCP4") != (ip.To4() != nil) || (proto != "TCP4" && proto != "TCP6") {
+		return nil, fmt.Errorf("%w: address %q does not match %s", ErrInvalidHeader, host, proto)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad port %q", ErrInvalidHeader, port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+const (
+	v2CmdLocal = 0x0
+	v2CmdProxy = 0x1
+
+	v2FamTCP4 = 0x11
+	v2FamUDP4 = 0x12
+	v2FamTCP6 = 0x21
+	v2FamUDP6 = 0x22
+	v2FamUnix = 0x31
+)
+
+func readV2(r *bufio.Reader) (*Header, error) {
+	var fixed [16]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return nil, err
+	}
+
+	verCmd, fam := fixed[12], fixed[13]
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("%w: v2 version %d", ErrInvalidHeader, verCmd>>4)
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(fixed[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	switch verCmd & 0xf {
+	case v2CmdLocal:
+		return &Header{Version: 2, Local: true}, nil
+	case v2CmdProxy:
+	default:
+		return nil, fmt.Errorf("%w: v2 command %d", ErrInvalidHeader, verCmd&0xf)
+	}
+
+	h := &Header{Version: 2}
+	switch fam {
+	case v2FamTCP4, v2FamUDP4:
+		if len(body) < 12 {
+			return nil, fmt.Errorf("%w: short IPv4 address block", ErrInvalidHeader)
+		}
+		h.Source = v2Addr(fam, body[0:4], body[8:10])
+		h.Destination = v2Addr(fam, body[4:8], body[10:12])
+	case v2FamTCP6, v2FamUDP6:
+		if len(body) < 36 {
+			return nil, fmt.Errorf("%w: short IPv6 address block", ErrInvalidHeader)
+		}
+		h.Source = v2Addr(fam, body[0:16], body[32:34])
+		h.Destination = v2Addr(fam, body[16:32], body[34:36])
+	case v2FamUnix:
+		if len(body) < 216 {
+			return nil, fmt.Errorf("%w: short unix address block", ErrInvalidHeader)
+		}
+		h.Source = &net.UnixAddr{Name: cString(body[0:108]), Net: "unix"}
+		h.Destination = &net.UnixAddr{Name: cString(body[108:216]), Net: "unix"}
+	default:
+		// unspecified family: the proxy forwards the connection but knows no addresses
+		h.Local = true
+	}
+	return h, nil
+}
+
+func v2Addr(fam byte, ip, port []byte) net.Addr {
+	addrIP := net.IP(bytes.Clone(ip))
+	p := int(binary.BigEndian.Uint16(port))
+	if fam == v2FamUDP4 || fam == v2FamUDP6 {
+		return &net.UDPAddr{IP: addrIP, Port: p}
+	}
+	return &net.TCPAddr{IP: addrIP, Port: p}
+}
+
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// AppendV1 appends a v1 header describing src and dst, which must both be TCP
+// addresses of the same family.
+func AppendV1(dst []byte, src, dest *net.TCPAddr) []byte {
+	proto := "TCP4"
+	if src.IP.To4() == nil {
+		proto = "TCP6"
+	}
+	return fmt.Appendf(dst, "PROXY %s %s %s %d %d\r\n", proto, src.IP, dest.IP, src.Port, dest.Port)
+}
+
+// AppendV2 appends a v2 PROXY header describing src and dst.
+func AppendV2(dst []byte, src, dest *net.TCPAddr) []byte {
+	dst = append(dst, v2Signature...)
+	dst = append(dst, 0x20|v2CmdProxy)
+	if src4, dest4 := src.IP.To4(), dest.IP.To4(); src4 != nil && dest4 != nil {
+		dst = append(dst, v2FamTCP4)
+		dst = binary.BigEndian.AppendUint16(dst, 12)
+		dst = append(dst, src4...)
+		dst = append(dst, dest4...)
+	} else {
+		dst = append(dst, v2FamTCP6)
+		dst = binary.BigEndian.AppendUint16(dst, 36)
+		dst = append(dst, src.IP.To16()...)
+		dst = append(dst, dest.IP.To16()...)
+	}
+	dst = binary.BigEndian.AppendUint16(dst, uint16(src.Port))
+	return binary.BigEndian.AppendUint16(dst, uint16(dest.Port))
+}
+
+// Conn is a net.Conn whose addresses come from a parsed PROXY header and whose reads
+// continue from the buffer the header was parsed with.
+type Conn struct {
+	net.Conn
+	r      *bufio.Reader
+	header *Header
+}
+
+func NewConn(conn net.Conn, r *bufio.Reader, h *Header) *Conn {
+	return &Conn{Conn: conn, r: r, header: h}
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// Header returns the parsed header, or nil if the connection arrived without one.
+func (c *Conn) Header() *Header {
+	return c.header
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.header != nil && c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	if c.header != nil && c.header.Destination != nil {
+		return c.header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
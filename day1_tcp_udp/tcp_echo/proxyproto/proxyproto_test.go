@@ -0,0 +1,104 @@
+package proxyproto_test
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/pixperk/bloodsport/day1_tcp_udp/tcp_echo/proxyproto"
+)
+
+func TestReadRoundTrip(t *testing.T) {
+	pairs := map[string][2]*net.TCPAddr{
+		"IPv4": {{IP: net.ParseIP("203.0.113.7"), Port: 51000}, {IP: net.ParseIP("192.0.2.1"), Port: 443}},
+		"IPv6": {{IP: net.ParseIP("2001:db8::7"), Port: 51000}, {IP: net.ParseIP("2001:db8::1"), Port: 443}},
+	}
+	for name, pair := range pairs {
+		src, dst := pair[0], pair[1]
+		for version, hdr := range map[int][]byte{
+			1: proxyproto.AppendV1(nil, src, dst),
+			2: proxyproto.AppendV2(nil, src, dst),
+		} {
+			r := bufio.NewReader(bytes.NewReader(append(hdr, "payload"...)))
+			h, err := proxyproto.Read(r)
+			if err != nil {
+				t.Fatalf("%s v%d: Read failed: %v", name, version, err)
+			}
+			if h.Version != version || h.Local || h.Source.String() != src.String() || h.Destination.String() != dst.String() {
+				t.Errorf("%s v%d: Expected %v -> %v, got %+v", name, version, src, dst, h)
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != "payload" {
+				t.Errorf("%s v%d: Expected the payload left unread, got %q", name, version, rest)
+			}
+		}
+	}
+}
+
+func TestReadLocal(t *testing.T) {
+	local := []byte("\r\n\r\n\x00\r\nQUIT\n\x20\x00\x00\x00")
+	for name, hdr := range map[string][]byte{
+		"v1 UNKNOWN": []byte("PROXY UNKNOWN\r\n"),
+		"v2 LOCAL":   local,
+	} {
+		h, err := proxyproto.Read(bufio.NewReader(bytes.NewReader(hdr)))
+		if err != nil || !h.Local || h.Source != nil || h.Destination != nil {
+			t.Errorf("%s: Expected a local header, got %+v (%v)", name, h, err)
+		}
+	}
+}
+
+func TestReadNoHeader(t *testing.T) {
+	// a short message that shares the start of a signature is not waited on
+	for _, msg := range []string{"hello\n", "PROX\n", "\r\n"} {
+		r := bufio.NewReader(strings.NewReader(msg))
+		if _, err := proxyproto.Read(r); !errors.Is(err, proxyproto.ErrNoHeader) {
+			t.Errorf("%q: Expected ErrNoHeader, got %v", msg, err)
+		}
+		if rest, _ := io.ReadAll(r); string(rest) != msg {
+			t.Errorf("%q: Expected nothing consumed, %q left", msg, rest)
+		}
+	}
+}
+
+func TestReadRejectsInvalid(t *testing.T) {
+	for name, hdr := range map[string]string{
+		"v1 no CRLF":         "PROXY TCP4 203.0.113.7 192.0.2.1 51000 443\n",
+		"v1 too long":        "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n",
+		"v1 missing port":    "PROXY TCP4 203.0.113.7 192.0.2.1 51000\r\n",
+		"v1 family mismatch": "PROXY TCP6 203.0.113.7 192.0.2.1 51000 443\r\n",
+		"v1 bad port":        "PROXY TCP4 203.0.113.7 192.0.2.1 51000 70000\r\n",
+		"v2 version":         "\r\n\r\n\x00\r\nQUIT\n\x31\x11\x00\x00",
+		"v2 command":         "\r\n\r\n\x00\r\nQUIT\n\x22\x11\x00\x00",
+		"v2 short block":     "\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x04\x01\x02\x03\x04",
+	} {
+		if h, err := proxyproto.Read(bufio.NewReader(strings.NewReader(hdr))); !errors.Is(err, proxyproto.ErrInvalidHeader) {
+			t.Errorf("%s: Expected ErrInvalidHeader, got %+v (%v)", name, h, err)
+		}
+	}
+}
+
+func TestConnAddresses(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	src := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51000}
+	dst := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 443}
+	r := bufio.NewReader(strings.NewReader("buffered"))
+	c := proxyproto.NewConn(server, r, &proxyproto.Header{Version: 2, Source: src, Destination: dst})
+	if c.RemoteAddr() != src || c.LocalAddr() != dst {
+		t.Errorf("Expected the header's addresses, got %v -> %v", c.RemoteAddr(), c.LocalAddr())
+	}
+	if b, _ := io.ReadAll(c); string(b) != "buffered" {
+		t.Errorf("Expected reads to continue from the buffer, got %q", b)
+	}
+
+	bare := proxyproto.NewConn(server, r, nil)
+	if bare.Header() != nil || bare.RemoteAddr() != server.RemoteAddr() {
+		t.Errorf("Expected the underlying addresses without a header, got %v", bare.RemoteAddr())
+	}
+}
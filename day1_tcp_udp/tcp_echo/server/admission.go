@@ -0,0 +1,217 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errMaxConns      = errors.New("server busy")
+	errMaxConnsPerIP = errors.New("too many connections from your address")
+	errAcceptRate    = errors.New("connection rate exceeded")
+)
+
+// rejectWriteTimeout bounds how long a refused client gets to receive its error line.
+const rejectWriteTimeout = time.Second
+
+// ipSweepInterval is how often idle per-IP rate state is garbage collected.
+const ipSweepInterval = time.Minute
+
+// WithMaxConns caps the number of live connections across all clients.
+func WithMaxConns(n int) Option {
+	return func(s *TCPServer) {
+		s.maxConns = n
+	}
+}
+
+// WithMaxConnsPerIP caps the number of live connections from one source IP.
+func WithMaxConnsPerIP(n int) Option {
+	return func(s *TCPServer) {
+		s.maxConnsPerIP = n
+	}
+}
+
+// WithAcceptRate limits each source IP to perSecond new connections on average,
+// with bursts of up to burst connections.
+func WithAcceptRate(perSecond float64, burst int) Option {
+	return func(s *TCPServer) {
+		s.acceptRate = perSecond
+		s.acceptBurst = max(burst, 1)
+	}
+}
+
+// Limits returns the current WithMaxConns and WithMaxConnsPerIP caps; zero is unlimited.
+func (s *TCPServer) Limits() (maxConns, maxConnsPerIP int) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.maxConns, s.maxConnsPerIP
+}
+
+// SetLimits changes the connection caps on a running server. Connections already
+// admitted are kept even if they now exceed a cap.
+func (s *TCPServer) SetLimits(maxConns, maxConnsPerIP int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxConns, s.maxConnsPerIP = maxConns, maxConnsPerIP
+}
+
+type Stats struct {
+	Active int
+	// Accepted counts the connections admitted past every limit, not those refused.
+	Accepted uint64
+
+	RejectedMaxConns uint64
+	RejectedPerIP    uint64
+	RejectedRate     uint64
+
+	// Shards counts the connections each listener accepted, in the order Serve was
+	// called, before any admission check.
+	Shards []uint64
+}
+
+type serverStats struct {
+	accepted         atomic.Uint64
+	rejectedMaxConns atomic.Uint64
+	rejectedPerIP    atomic.Uint64
+	rejectedRate     atomic.Uint64
+}
+
+func (s *TCPServer) Stats() Stats {
+	s.mu.RLock()
+	active := len(s.connections)
+	shards := make([]uint64, len(s.shardAccepts))
+	for i, n := range s.shardAccepts {
+		shards[i] = n.Load()
+	}
+	s.mu.RUnlock()
+
+	return Stats{
+		Active:           active,
+		Accepted:         s.stats.accepted.Load(),
+		RejectedMaxConns: s.stats.rejectedMaxConns.Load(),
+		RejectedPerIP:    s.stats.rejectedPerIP.Load(),
+		RejectedRate:     s.stats.rejectedRate.Load(),
+		Shards:           shards,
+	}
+}
+
+// ipState tracks one source IP's live connections and its accept-rate token bucket.
+type ipState struct {
+	conns  int
+	tokens float64
+	last   time.Time
+}
+
+func remoteIP(addr net.Addr) string {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// admit decides whether a connection from ip may be registered and, if so, counts it
+// against the per-IP limits. s.mu must be held.
+func (s *TCPServer) admit(ip string) error {
+	if time.Since(s.lastSweep) > ipSweepInterval {
+		for ip, st := range s.perIP {
+			s.keepIPState(ip, st)
+		}
+		s.lastSweep = time.Now()
+	}
+
+	st := s.perIP[ip]
+	if st == nil {
+		st = &ipState{tokens: float64(s.acceptBurst), last: time.Now()}
+	}
+
+	if s.acceptRate > 0 {
+		now := time.Now()
+		st.tokens = min(st.tokens+now.Sub(st.last).Seconds()*s.acceptRate, float64(s.acceptBurst))
+		st.last = now
+		if st.tokens < 1 {
+			s.keepIPState(ip, st)
+			s.stats.rejectedRate.Add(1)
+			return errAcceptRate
+		}
+	}
+
+	if s.maxConns > 0 && s.admitted >= s.maxConns {
+		s.keepIPState(ip, st)
+		s.stats.rejectedMaxConns.Add(1)
+		return errMaxConns
+	}
+	if s.maxConnsPerIP > 0 && st.conns >= s.maxConnsPerIP {
+		s.keepIPState(ip, st)
+		s.stats.rejectedPerIP.Add(1)
+		return errMaxConnsPerIP
+	}
+
+	// only an admitted connection spends a token, so refusals do not eat into the rate
+	if s.acceptRate > 0 {
+		st.tokens--
+	}
+	st.conns++
+	s.admitted++
+	s.perIP[ip] = st
+	s.stats.accepted.Add(1)
+	return nil
+}
+
+// release undoes admit once a connection from ip has gone. s.mu must be held.
+func (s *TCPServer) release(ip string) {
+	s.admitted--
+	st := s.perIP[ip]
+	if st == nil {
+		return
+	}
+	st.conns--
+	s.keepIPState(ip, st)
+}
+
+// keepIPState stores st, or forgets ip entirely once it holds no connections and
+// its bucket would have refilled anyway.
+func (s *TCPServer) keepIPState(ip string, st *ipState) {
+	refilled := s.acceptRate <= 0 ||
+		st.tokens+time.Since(st.last).Seconds()*s.acceptRate >= float64(s.acceptBurst)
+	if st.conns <= 0 && refilled {
+		delete(s.perIP, ip)
+		return
+	}
+	s.perIP[ip] = st
+}
+
+// admitConn runs admission for a connection registered before its client address was
+// known, such as one whose PROXY header has just been read.
+func (s *TCPServer) admitConn(cc *ConnContext) error {
+	ip := remoteIP(cc.RemoteAddr)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.admit(ip); err != nil {
+		return err
+	}
+	cc.admittedIP, cc.admitted = ip, true
+	return nil
+}
+
+// reject tells the client why it was refused, then closes the connection. It runs off
+// the accept loop so a slow client (or a TLS handshake) cannot stall accepting.
+func (s *TCPServer) reject(conn net.Conn, reason error) {
+	defer conn.Close()
+	if s.tlsConfig != nil {
+		conn = tls.Server(conn, s.tlsConfig)
+	}
+	frame, err := s.codec.AppendFrame(nil, []byte("ERR "+reason.Error()))
+	if err != nil {
+		return
+	}
+	conn.SetWriteDeadline(time.Now().Add(rejectWriteTimeout))
+	conn.Write(frame)
+}
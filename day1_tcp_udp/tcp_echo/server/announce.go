@@ -0,0 +1,42 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/pixperk/bloodsport/day1_tcp_udp/discovery"
+)
+
+// WithAnnouncer announces the server on a multicast group while it serves, with the
+// number of live connections as its load, and withdraws it on Shutdown. Only TCP
+// listeners are announced; with several, the first one is.
+func WithAnnouncer(a discovery.Announcer) Option {
+	return func(s *TCPServer) {
+		s.announcer = &a
+	}
+}
+
+// announce starts the announcer for the listener at addr.
+func (s *TCPServer) announce(addr net.Addr) {
+	if _, ok := addr.(*net.TCPAddr); !ok {
+		fmt.Printf("not announcing %v: only TCP listeners can be discovered\n", addr)
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		cancel()
+		return
+	}
+	s.stopAnnounce = cancel
+	s.mu.Unlock()
+
+	go func() {
+		load := func() int { return s.Stats().Active }
+		if err := s.announcer.Run(ctx, "tcp", addr.String(), load); err != nil {
+			fmt.Printf("announcing %s stopped: %v\n", s.announcer.Service, err)
+		}
+	}()
+}
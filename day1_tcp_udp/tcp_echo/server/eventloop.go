@@ -0,0 +1,64 @@
+package server
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+)
+
+// errNotPollable is returned by an engine for a connection it cannot watch, such as an
+// in-memory pipe; the server then serves it with a goroutine as usual.
+var errNotPollable = errors.New("connection has no pollable socket")
+
+// engine serves registered connections in place of handleConn.
+type engine interface {
+	add(cc *ConnContext) error
+}
+
+// WithEventLoop serves connections from loops event-loop goroutines driven by epoll
+// instead of one goroutine per connection. A connection costs no goroutine and no
+// read buffer while it is idle, which suits many mostly-idle clients. Zero or less
+// means one loop per GOMAXPROCS. It is only supported on Linux and cannot be combined
+// with TLS or the PROXY protocol.
+//
+// Handlers run on the loop that owns the connection, so a handler that blocks (for
+// example on a slow client's writes) delays every other connection on that loop.
+//
+// On Shutdown each loop, within loopPollInterval, finishes handling the frames it has
+// already read and then closes all of its connections at once, as a goroutine
+// connection closes after its current message. The Shutdown context only bounds a
+// handler still running; no connection is kept open for the rest of its grace period.
+func WithEventLoop(loops int) Option {
+	return func(s *TCPServer) {
+		if loops <= 0 {
+			loops = runtime.GOMAXPROCS(0)
+		}
+		s.eventLoops = loops
+	}
+}
+
+// startEngine creates the event loops on the first call to Serve.
+func (s *TCPServer) startEngine() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.engine != nil {
+		return nil
+	}
+	if s.tlsConfig != nil || s.proxy != nil {
+		return errors.New("the event loop engine supports neither TLS nor the PROXY protocol")
+	}
+	e, err := newEventLoops(s, s.eventLoops)
+	if err != nil {
+		return err
+	}
+	s.engine = e
+	return nil
+}
+
+// framePool holds buffers for frames that arrive split across reads.
+var framePool = sync.Pool{
+	New: func() any {
+		b := make([]byte, 0, 4096)
+		return &b
+	},
+}
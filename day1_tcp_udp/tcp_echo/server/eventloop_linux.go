@@ -0,0 +1,294 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/pixperk/bloodsport/day1_tcp_udp/tcp_echo/framing"
+)
+
+// loopPollInterval bounds how long an event loop waits before noticing Shutdown and
+// sweeping idle or externally closed connections.
+const loopPollInterval = 100 * time.Millisecond
+
+const loopSweepInterval = time.Second
+
+// loopReadSize is the per-loop read buffer; connections only own memory while they
+// hold part of a frame.
+const loopReadSize = 64 * 1024
+
+var errLoopStopped = errors.New("event loop stopped")
+
+type eventLoops struct {
+	loops []*eventLoop
+	next  atomic.Uint64
+}
+
+type eventLoop struct {
+	s    *TCPServer
+	epfd int
+	buf  []byte
+
+	mu      sync.Mutex
+	conns   map[int]*loopConn
+	orphans []*loopConn
+	stopped bool
+}
+
+// loopConn is one connection owned by an event loop.
+type loopConn struct {
+	cc      *ConnContext
+	fd      int
+	rc      syscall.RawConn
+	pending *[]byte // partial frame from framePool, nil when there is none
+}
+
+func newEventLoops(s *TCPServer, n int) (engine, error) {
+	e := &eventLoops{}
+	for range n {
+		epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+		if err != nil {
+			for _, l := range e.loops {
+				l.stop()
+			}
+			return nil, fmt.Errorf("epoll_create1: %w", err)
+		}
+		e.loops = append(e.loops, &eventLoop{
+			s:     s,
+			epfd:  epfd,
+			buf:   make([]byte, loopReadSize),
+			conns: make(map[int]*loopConn),
+		})
+	}
+	for _, l := range e.loops {
+		go l.run()
+	}
+	return e, nil
+}
+
+func (e *eventLoops) add(cc *ConnContext) error {
+	m, ok := cc.raw.(*meteredConn)
+	if !ok {
+		return errNotPollable
+	}
+	sc, ok := m.Conn.(syscall.Conn)
+	if !ok {
+		return errNotPollable
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return errNotPollable
+	}
+	lc := &loopConn{cc: cc, rc: rc}
+	if err := rc.Control(func(fd uintptr) { lc.fd = int(fd) }); err != nil {
+		return err
+	}
+
+	// the engine takes neither TLS nor the PROXY protocol, so there is nothing to wait for
+	cc.established.Store(true)
+	l := e.loops[e.next.Add(1)%uint64(len(e.loops))]
+	obs, _ := l.s.handler.(ConnObserver)
+	if obs != nil {
+		obs.OnConnect(cc)
+	}
+
+	l.mu.Lock()
+	if l.stopped {
+		l.mu.Unlock()
+		if obs != nil {
+			obs.OnDisconnect(cc)
+		}
+		return errLoopStopped
+	}
+	// a descriptor we still track was closed behind our back (by Kick, say) and the
+	// kernel has handed its number to this connection; the loop cleans the old one up
+	if stale := l.conns[lc.fd]; stale != nil {
+		l.orphans = append(l.orphans, stale)
+	}
+	l.conns[lc.fd] = lc
+	l.mu.Unlock()
+
+	ev := syscall.EpollEvent{Events: syscall.EPOLLIN | syscall.EPOLLRDHUP, Fd: int32(lc.fd)}
+	if err := syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_ADD, lc.fd, &ev); err != nil {
+		l.drop(lc)
+		return nil
+	}
+	return nil
+}
+
+func (l *eventLoop) run() {
+	events := make([]syscall.EpollEvent, 256)
+	lastSweep := time.Now()
+	for {
+		n, err := syscall.EpollWait(l.epfd, events, int(loopPollInterval/time.Millisecond))
+		if err != nil && err != syscall.EINTR {
+			fmt.Printf("epoll_wait: %v\n", err)
+			l.stop()
+			return
+		}
+		for _, ev := range events[:max(n, 0)] {
+			l.mu.Lock()
+			lc := l.conns[int(ev.Fd)]
+			l.mu.Unlock()
+			if lc != nil {
+				l.serve(lc)
+			}
+		}
+
+		l.mu.Lock()
+		orphans := l.orphans
+		l.orphans = nil
+		l.mu.Unlock()
+		for _, lc := range orphans {
+			l.finish(lc)
+		}
+
+		if l.s.isClosing() {
+			l.stop()
+			return
+		}
+		if time.Since(lastSweep) >= loopSweepInterval {
+			l.sweep()
+			lastSweep = time.Now()
+		}
+	}
+}
+
+// serve reads what lc's socket has ready and hands every complete frame to the handler.
+func (l *eventLoop) serve(lc *loopConn) {
+	var n int
+	var readErr error
+	err := lc.rc.Read(func(fd uintptr) bool {
+		n, readErr = syscall.Read(int(fd), l.buf)
+		return true
+	})
+	if readErr == syscall.EAGAIN {
+		return
+	}
+	if err != nil || readErr != nil || n <= 0 {
+		l.drop(lc)
+		return
+	}
+	cc := lc.cc
+	cc.bytesIn.Add(uint64(n))
+	cc.lastActivity.Store(time.Now().UnixNano())
+
+	data := l.buf[:n]
+	if lc.pending != nil {
+		*lc.pending = append(*lc.pending, data...)
+		data = *lc.pending
+	}
+
+	for len(data) > 0 {
+		msg, used, err := l.s.codec.Split(data, l.s.maxFrameSize)
+		if errors.Is(err, framing.ErrFrameTooLarge) {
+			fmt.Printf("conn %d sent a frame over %d bytes, disconnecting\n", cc.ID, l.s.maxFrameSize)
+			cc.Send([]byte("ERR " + err.Error()))
+			l.drop(lc)
+			return
+		} else if err != nil {
+			fmt.Println("read error:", err)
+			l.drop(lc)
+			return
+		}
+		if used == 0 {
+			break
+		}
+		// data is reused by the next read; handlers may keep what they are given
+		if err := l.s.handler.Handle(cc, bytes.Clone(msg)); err != nil {
+			fmt.Printf("handler error on conn %d: %v\n", cc.ID, err)
+			l.drop(lc)
+			return
+		}
+		data = data[used:]
+	}
+
+	switch {
+	case len(data) == 0:
+		l.release(lc)
+	case lc.pending == nil:
+		lc.pending = framePool.Get().(*[]byte)
+		*lc.pending = append((*lc.pending)[:0], data...)
+	default:
+		*lc.pending = (*lc.pending)[:copy(*lc.pending, data)]
+	}
+}
+
+// sweep drops connections that have been idle too long or were closed elsewhere.
+func (l *eventLoop) sweep() {
+	l.mu.Lock()
+	conns := make([]*loopConn, 0, len(l.conns))
+	for _, lc := range l.conns {
+		conns = append(conns, lc)
+	}
+	l.mu.Unlock()
+
+	for _, lc := range conns {
+		if lc.rc.Control(func(uintptr) {}) != nil {
+			l.drop(lc)
+		} else if l.s.idleTimeout > 0 && time.Since(lc.cc.LastActivity()) > l.s.idleTimeout {
+			fmt.Printf("conn %d idle for %v, disconnecting\n", lc.cc.ID, l.s.idleTimeout)
+			l.drop(lc)
+		}
+	}
+}
+
+// stop closes every connection and the epoll instance; later adds are refused.
+func (l *eventLoop) stop() {
+	l.mu.Lock()
+	l.stopped = true
+	conns := make([]*loopConn, 0, len(l.conns))
+	for _, lc := range l.conns {
+		conns = append(conns, lc)
+	}
+	l.mu.Unlock()
+
+	for _, lc := range conns {
+		l.drop(lc)
+	}
+	for _, lc := range l.orphans {
+		l.finish(lc)
+	}
+	l.orphans = nil
+	syscall.Close(l.epfd)
+}
+
+// drop unregisters lc and closes its connection.
+func (l *eventLoop) drop(lc *loopConn) {
+	l.mu.Lock()
+	if l.conns[lc.fd] != lc {
+		l.mu.Unlock()
+		return
+	}
+	delete(l.conns, lc.fd)
+	l.mu.Unlock()
+
+	lc.rc.Control(func(fd uintptr) {
+		syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_DEL, int(fd), nil)
+	})
+	l.finish(lc)
+}
+
+// finish does what handleConn's deferred cleanup does for a goroutine connection.
+func (l *eventLoop) finish(lc *loopConn) {
+	l.release(lc)
+	if obs, ok := l.s.handler.(ConnObserver); ok {
+		obs.OnDisconnect(lc.cc)
+	}
+	l.s.removeConnection(lc.cc)
+	lc.cc.raw.Close()
+	l.s.connWG.Done()
+}
+
+func (l *eventLoop) release(lc *loopConn) {
+	if lc.pending != nil {
+		*lc.pending = (*lc.pending)[:0]
+		framePool.Put(lc.pending)
+		lc.pending = nil
+	}
+}
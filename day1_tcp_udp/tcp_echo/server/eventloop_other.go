@@ -0,0 +1,9 @@
+//go:build !linux
+
+package server
+
+import "errors"
+
+func newEventLoops(s *TCPServer, n int) (engine, error) {
+	return nil, errors.New("the event loop engine is only supported on Linux")
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pixperk/bloodsport/day1_tcp_udp/tcp_echo/framing"
+	"github.com/pixperk/bloodsport/day1_tcp_udp/tcpinfo"
+)
+
+// Handler serves one message read from a connection: a line without its trailing newline
+// by default, or one frame's payload with WithCodec.
+// Returning an error closes the connection.
+type Handler interface {
+	Handle(cc *ConnContext, msg []byte) error
+}
+
+// ConnObserver is implemented by handlers that keep per-connection state. OnConnect runs
+// before the first message is read, once any TLS handshake has completed; OnDisconnect
+// runs after the connection's read loop has ended.
+type ConnObserver interface {
+	OnConnect(cc *ConnContext)
+	OnDisconnect(cc *ConnContext)
+}
+
+type HandlerFunc func(cc *ConnContext, msg []byte) error
+
+func (f HandlerFunc) Handle(cc *ConnContext, msg []byte) error {
+	return f(cc, msg)
+}
+
+// EchoHandler replies to every message with "Echo: <message>".
+func EchoHandler() Handler {
+	return HandlerFunc(func(cc *ConnContext, msg []byte) error {
+		return cc.Send(append([]byte("Echo: "), msg...))
+	})
+}
+
+// ConnContext is the per-connection state handed to a Handler.
+type ConnContext struct {
+	ID          uint64
+	RemoteAddr  net.Addr
+	LocalAddr   net.Addr
+	ConnectedAt time.Time
+
+	// ProxyAddr is the proxy's own address when a PROXY protocol header supplied
+	// RemoteAddr and LocalAddr; it is nil for direct connections.
+	ProxyAddr net.Addr
+
+	// TLS is set once the handshake has completed on a TLS server. PeerIdentity is
+	// the verified client certificate's identity, empty without a verified cert.
+	TLS          *tls.ConnectionState
+	PeerIdentity string
+
+	// raw is the accepted connection; conn is what replies are written to, which may
+	// wrap raw in TLS.
+	raw          net.Conn
+	conn         net.Conn
+	wmu          sync.Mutex
+	writeTimeout time.Duration
+	codec        framing.Codec
+
+	admittedIP string
+	admitted   bool
+
+	// established is set once the PROXY header and TLS handshake are done, after
+	// which RemoteAddr, LocalAddr, ProxyAddr, TLS and PeerIdentity no longer change
+	// and may be read from other goroutines.
+	established atomic.Bool
+
+	bytesIn      atomic.Uint64
+	bytesOut     atomic.Uint64
+	lastActivity atomic.Int64
+	tcpInfo      atomic.Pointer[tcpinfo.Info]
+}
+
+func newConnContext(id uint64, conn net.Conn) *ConnContext {
+	cc := &ConnContext{
+		ID:          id,
+		RemoteAddr:  conn.RemoteAddr(),
+		LocalAddr:   conn.LocalAddr(),
+		ConnectedAt: time.Now(),
+		codec:       framing.Newline,
+	}
+	cc.lastActivity.Store(cc.ConnectedAt.UnixNano())
+	cc.raw = &meteredConn{Conn: conn, cc: cc}
+	cc.conn = cc.raw
+	return cc
+}
+
+// BytesIn and BytesOut count bytes on the wire, including framing and any TLS overhead.
+func (cc *ConnContext) BytesIn() uint64  { return cc.bytesIn.Load() }
+func (cc *ConnContext) BytesOut() uint64 { return cc.bytesOut.Load() }
+
+// LastActivity is when the connection last read or wrote any bytes.
+func (cc *ConnContext) LastActivity() time.Time {
+	return time.Unix(0, cc.lastActivity.Load())
+}
+
+// meteredConn counts traffic on the accepted connection for ConnContext.
+type meteredConn struct {
+	net.Conn
+	cc *ConnContext
+}
+
+func (m *meteredConn) Read(p []byte) (int, error) {
+	n, err := m.Conn.Read(p)
+	if n > 0 {
+		m.cc.bytesIn.Add(uint64(n))
+		m.cc.lastActivity.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (m *meteredConn) Write(p []byte) (int, error) {
+	n, err := m.Conn.Write(p)
+	if n > 0 {
+		m.cc.bytesOut.Add(uint64(n))
+		m.cc.lastActivity.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// NetConn returns the accepted connection so its socket can be inspected.
+func (m *meteredConn) NetConn() net.Conn {
+	return m.Conn
+}
+
+func (cc *ConnContext) setConn(conn net.Conn) {
+	cc.wmu.Lock()
+	cc.conn = conn
+	cc.wmu.Unlock()
+}
+
+// Write writes raw bytes to the connection. It is safe for concurrent use.
+func (cc *ConnContext) Write(p []byte) (int, error) {
+	cc.wmu.Lock()
+	defer cc.wmu.Unlock()
+	if cc.writeTimeout > 0 {
+		cc.conn.SetWriteDeadline(time.Now().Add(cc.writeTimeout))
+	}
+	return cc.conn.Write(p)
+}
+
+// Send writes msg as a single frame, a newline-terminated line by default.
+func (cc *ConnContext) Send(msg []byte) error {
+	frame, err := cc.codec.AppendFrame(make([]byte, 0, len(msg)+binary.MaxVarintLen64), msg)
+	if err != nil {
+		return err
+	}
+	_, err = cc.Write(frame)
+	return err
+}
+
+// Close closes the underlying connection, ending its read loop.
+func (cc *ConnContext) Close() error {
+	return cc.raw.Close()
+}
@@ -0,0 +1,37 @@
+package server
+
+import (
+	"crypto/tls"
+
+	"github.com/pixperk/bloodsport/day1_tcp_udp/tcp_echo/framing"
+)
+
+// defaultMaxFrameSize bounds a frame when WithMaxFrameSize is not given.
+const defaultMaxFrameSize = 64 * 1024
+
+type Option func(*TCPServer)
+
+// WithTLS serves TLS using cfg. When cfg verifies client certificates, the verified
+// identity is available to handlers as ConnContext.PeerIdentity.
+func WithTLS(cfg *tls.Config) Option {
+	return func(s *TCPServer) {
+		s.tlsConfig = cfg
+	}
+}
+
+// WithCodec frames messages with c instead of newline-delimited lines.
+func WithCodec(c framing.Codec) Option {
+	return func(s *TCPServer) {
+		s.codec = c
+	}
+}
+
+// WithMaxFrameSize caps a frame's payload at n bytes. A client that sends a larger
+// frame gets an error reply and is disconnected. The default is 64KiB.
+func WithMaxFrameSize(n int) Option {
+	return func(s *TCPServer) {
+		if n > 0 {
+			s.maxFrameSize = n
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/pixperk/bloodsport/day1_tcp_udp/tcp_echo/proxyproto"
+)
+
+var (
+	errMissingProxyHeader = errors.New("missing PROXY header")
+	errUntrustedProxy     = errors.New("peer is not a trusted proxy")
+)
+
+type proxyConfig struct {
+	strict  bool
+	trusted []netip.Prefix
+}
+
+// WithProxyProtocol reads a PROXY protocol v1 or v2 header at the start of connections
+// from trusted proxies, so ConnContext.RemoteAddr and LocalAddr carry the original
+// client and destination addresses. Connection limits then apply per client too.
+//
+// With no trusted prefixes every peer is trusted. Untrusted peers are served as direct
+// connections without looking for a header. In strict mode every connection must come
+// from a trusted proxy and begin with a header; anything else is dropped. A trusted
+// peer that sends nothing within the handshake timeout is dropped either way.
+func WithProxyProtocol(strict bool, trusted ...netip.Prefix) Option {
+	return func(s *TCPServer) {
+		s.proxy = &proxyConfig{strict: strict, trusted: trusted}
+	}
+}
+
+func (p *proxyConfig) trusts(addr net.Addr) bool {
+	if len(p.trusted) == 0 {
+		return true
+	}
+	ip, err := netip.ParseAddr(remoteIP(addr))
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, prefix := range p.trusted {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// readProxyHeader consumes the PROXY header from a trusted peer and returns the
+// connection to read the rest of the stream from, with the addresses the header gave.
+func (s *TCPServer) readProxyHeader(cc *ConnContext, conn net.Conn) (net.Conn, error) {
+	if !s.proxy.trusts(conn.RemoteAddr()) {
+		if s.proxy.strict {
+			return nil, errUntrustedProxy
+		}
+		return conn, nil
+	}
+
+	if !s.armDeadline(conn, handshakeTimeout) {
+		return nil, ErrServerClosed
+	}
+	r := bufio.NewReader(conn)
+	hdr, err := proxyproto.Read(r)
+	if err == proxyproto.ErrNoHeader {
+		if s.proxy.strict {
+			return nil, errMissingProxyHeader
+		}
+		hdr = nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	pc := proxyproto.NewConn(conn, r, hdr)
+	if hdr != nil && !hdr.Local {
+		cc.ProxyAddr = conn.RemoteAddr()
+		cc.RemoteAddr = pc.RemoteAddr()
+		cc.LocalAddr = pc.LocalAddr()
+		fmt.Printf("conn %d from %v to %v via proxy %v\n", cc.ID, cc.RemoteAddr, cc.LocalAddr, cc.ProxyAddr)
+	}
+	return pc, nil
+}
@@ -0,0 +1,255 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// SlowConsumerPolicy decides what happens when a subscriber's outbound queue is full.
+type SlowConsumerPolicy int
+
+const (
+	// DropOldest discards the oldest queued message to make room for the new one.
+	DropOldest SlowConsumerPolicy = iota
+
+	// Disconnect closes the subscriber's connection.
+	Disconnect
+)
+
+// defaultQueueSize is the per-subscriber queue length when NewPubSub is given zero.
+const defaultQueueSize = 256
+
+var errBadTopic = errors.New("invalid topic")
+
+// PubSub is a Handler that turns the server into a topic-based message broker. Clients
+// send line commands:
+//
+//	SUB <topic>        subscribe; topics are dot-separated, "*" matches one token and
+//	                   a trailing ">" matches one or more
+//	UNSUB <topic>      drop a subscription made with the same pattern
+//	PUB <topic> <msg>  deliver msg to every matching subscriber
+//
+// Commands are answered with "OK" or "ERR <reason>"; deliveries arrive as
+// "MSG <topic> <msg>". Each subscriber has a bounded queue drained by its own writer,
+// so a slow subscriber never blocks publishers.
+type PubSub struct {
+	queueSize int
+	policy    SlowConsumerPolicy
+
+	mu   sync.RWMutex
+	subs map[*ConnContext]*subscriber
+
+	published atomic.Uint64
+	dropped   atomic.Uint64
+}
+
+type subscriber struct {
+	cc       *ConnContext
+	queue    chan []byte
+	done     chan struct{}
+	patterns map[string][]string
+}
+
+// NewPubSub creates a broker whose subscribers queue up to queueSize messages each
+// before policy applies.
+func NewPubSub(queueSize int, policy SlowConsumerPolicy) *PubSub {
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
+	}
+	return &PubSub{
+		queueSize: queueSize,
+		policy:    policy,
+		subs:      make(map[*ConnContext]*subscriber),
+	}
+}
+
+func (ps *PubSub) Handle(cc *ConnContext, msg []byte) error {
+	cmd, rest, _ := bytes.Cut(msg, []byte(" "))
+	var err error
+	switch string(cmd) {
+	case "SUB":
+		err = ps.subscribe(cc, string(rest))
+	case "UNSUB":
+		err = ps.unsubscribe(cc, string(rest))
+	case "PUB":
+		topic, payload, _ := bytes.Cut(rest, []byte(" "))
+		err = ps.Publish(string(topic), payload)
+	default:
+		err = fmt.Errorf("unknown command %q", cmd)
+	}
+	if err != nil {
+		return cc.Send([]byte("ERR " + err.Error()))
+	}
+	return cc.Send([]byte("OK"))
+}
+
+func (ps *PubSub) OnConnect(cc *ConnContext) {}
+
+func (ps *PubSub) OnDisconnect(cc *ConnContext) {
+	ps.mu.Lock()
+	sub := ps.subs[cc]
+	delete(ps.subs, cc)
+	ps.mu.Unlock()
+
+	if sub != nil {
+		close(sub.done)
+	}
+}
+
+// Publish delivers msg to every subscriber whose pattern matches topic, as if a client
+// had sent PUB.
+func (ps *PubSub) Publish(topic string, msg []byte) error {
+	tokens, err := parseTopic(topic, false)
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, 0, len("MSG ")+len(topic)+1+len(msg))
+	frame = append(frame, "MSG "...)
+	frame = append(frame, topic...)
+	frame = append(frame, ' ')
+	frame = append(frame, msg...)
+
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	for _, sub := range ps.subs {
+		for _, pattern := range sub.patterns {
+			if matchTopic(pattern, tokens) {
+				ps.enqueue(sub, frame)
+				break
+			}
+		}
+	}
+	ps.published.Add(1)
+	return nil
+}
+
+// PubSubStats reports broker totals; Dropped counts messages discarded by DropOldest.
+type PubSubStats struct {
+	Subscribers int
+	Published   uint64
+	Dropped     uint64
+}
+
+func (ps *PubSub) Stats() PubSubStats {
+	ps.mu.RLock()
+	n := len(ps.subs)
+	ps.mu.RUnlock()
+	return PubSubStats{
+		Subscribers: n,
+		Published:   ps.published.Load(),
+		Dropped:     ps.dropped.Load(),
+	}
+}
+
+func (ps *PubSub) subscribe(cc *ConnContext, topic string) error {
+	tokens, err := parseTopic(topic, true)
+	if err != nil {
+		return err
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	sub := ps.subs[cc]
+	if sub == nil {
+		sub = &subscriber{
+			cc:       cc,
+			queue:    make(chan []byte, ps.queueSize),
+			done:     make(chan struct{}),
+			patterns: make(map[string][]string),
+		}
+		ps.subs[cc] = sub
+		go sub.writeLoop()
+	}
+	sub.patterns[topic] = tokens
+	return nil
+}
+
+func (ps *PubSub) unsubscribe(cc *ConnContext, topic string) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	sub := ps.subs[cc]
+	if sub == nil {
+		return fmt.Errorf("not subscribed to %q", topic)
+	}
+	if _, ok := sub.patterns[topic]; !ok {
+		return fmt.Errorf("not subscribed to %q", topic)
+	}
+	delete(sub.patterns, topic)
+	return nil
+}
+
+// enqueue hands frame to sub's writer without blocking, applying the slow-consumer
+// policy when the queue is full.
+func (ps *PubSub) enqueue(sub *subscriber, frame []byte) {
+	for {
+		select {
+		case sub.queue <- frame:
+			return
+		default:
+		}
+
+		if ps.policy == Disconnect {
+			fmt.Printf("conn %d is not keeping up with its subscriptions, disconnecting\n", sub.cc.ID)
+			sub.cc.Close()
+			return
+		}
+		select {
+		case <-sub.queue:
+			ps.dropped.Add(1)
+		default:
+		}
+	}
+}
+
+func (sub *subscriber) writeLoop() {
+	for {
+		select {
+		case frame := <-sub.queue:
+			if err := sub.cc.Send(frame); err != nil {
+				sub.cc.Close()
+				return
+			}
+		case <-sub.done:
+			return
+		}
+	}
+}
+
+// parseTopic splits a dot-separated topic into tokens. Wildcards are only valid in
+// subscription patterns, and ">" only as the last token.
+func parseTopic(topic string, wildcards bool) ([]string, error) {
+	if topic == "" || strings.ContainsAny(topic, " \t\r\n") {
+		return nil, fmt.Errorf("%w %q", errBadTopic, topic)
+	}
+	tokens := strings.Split(topic, ".")
+	for i, tok := range tokens {
+		switch {
+		case tok == "":
+			return nil, fmt.Errorf("%w %q: empty token", errBadTopic, topic)
+		case tok == "*" || tok == ">":
+			if !wildcards {
+				return nil, fmt.Errorf("%w %q: wildcards are only allowed in SUB", errBadTopic, topic)
+			}
+			if tok == ">" && i != len(tokens)-1 {
+				return nil, fmt.Errorf("%w %q: \">\" must be the last token", errBadTopic, topic)
+			}
+		}
+	}
+	return tokens, nil
+}
+
+func matchTopic(pattern, topic []string) bool {
+	for i, tok := range pattern {
+		if tok == ">" {
+			return len(topic) > i
+		}
+		if i >= len(topic) || (tok != "*" && tok != topic[i]) {
+			return false
+		}
+	}
+	return len(pattern) == len(topic)
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"context"
+	"net"
+	"strconv"
+)
+
+// WithReusePort opens n listeners on the same address with SO_REUSEPORT when the
+// server is started with Start or StartWithContext, each with its own accept loop, so
+// the kernel spreads incoming connections across them. Connections from every shard
+// share one registry and one set of limits; Stats.Shards shows the split. It is only
+// supported on Linux and only for TCP addresses.
+func WithReusePort(n int) Option {
+	return func(s *TCPServer) {
+		s.reusePort = n
+	}
+}
+
+// listenShards opens s.reusePort listeners on address. A port of 0 is resolved by the
+// first listener so that the rest join it.
+func (s *TCPServer) listenShards(ctx context.Context, address string) ([]net.Listener, error) {
+	lc := net.ListenConfig{Control: reusePortControl}
+	listeners := make([]net.Listener, 0, s.reusePort)
+	for range s.reusePort {
+		lis, err := lc.Listen(ctx, "tcp", address)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		if len(listeners) == 0 {
+			host, _, _ := net.SplitHostPort(address)
+			address = net.JoinHostPort(host, strconv.Itoa(lis.Addr().(*net.TCPAddr).Port))
+		}
+		listeners = append(listeners, lis)
+	}
+	return listeners, nil
+}
+
+// serveShards runs Serve on every listener and returns once all of them have. If one
+// shard fails the others are closed and its error is returned.
+func (s *TCPServer) serveShards(ctx context.Context, listeners []net.Listener) error {
+	errs := make(chan error, len(listeners))
+	for _, lis := range listeners {
+		go func() { errs <- s.Serve(ctx, lis) }()
+	}
+
+	var first error
+	for range listeners {
+		err := <-errs
+		if err == nil || first != nil {
+			continue
+		}
+		first = err
+		for _, lis := range listeners {
+			lis.Close()
+		}
+	}
+	return first
+}
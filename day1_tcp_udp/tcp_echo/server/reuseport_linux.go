@@ -0,0 +1,20 @@
+//go:build linux && !(mips || mipsle || mips64 || mips64le)
+
+package server
+
+import "syscall"
+
+// soReusePort is SO_REUSEPORT, which package syscall does not export on Linux. Its
+// value differs on MIPS, which therefore falls back to reuseport_other.go.
+const soReusePort = 0xf
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
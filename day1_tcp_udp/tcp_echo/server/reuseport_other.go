@@ -0,0 +1,12 @@
+//go:build !linux || mips || mipsle || mips64 || mips64le
+
+package server
+
+import (
+	"errors"
+	"syscall"
+)
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT sharding is only supported on Linux")
+}
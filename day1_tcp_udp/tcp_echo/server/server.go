@@ -2,101 +2,459 @@ package server
 
 import (
 	"bufio"
+	"cmp"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pixperk/bloodsport/day1_tcp_udp/discovery"
+	"github.com/pixperk/bloodsport/day1_tcp_udp/tcp_echo/framing"
+	"github.com/pixperk/bloodsport/day1_tcp_udp/tlsutil"
 )
 
+// ErrServerClosed is returned by StartWithContext when it is called after Shutdown.
+var ErrServerClosed = errors.New("tcp server closed")
+
+// shutdownTimeout bounds the drain triggered by cancelling the StartWithContext context.
+const shutdownTimeout = 5 * time.Second
+
+const handshakeTimeout = 10 * time.Second
+
 type TCPServer struct {
-	ListenAddr  string
-	mu          sync.RWMutex
-	connections map[net.Conn]bool
+	ListenAddr string
+	handler    Handler
+	tlsConfig  *tls.Config
+
+	mu           sync.RWMutex
+	listeners    []net.Listener
+	shardAccepts []*atomic.Uint64
+	ready        chan struct{}
+	readyOnce    sync.Once
+	closing      bool
+	connections  map[net.Conn]*ConnContext
+	nextID       atomic.Uint64
+
+	maxConns      int
+	maxConnsPerIP int
+	acceptRate    float64
+	acceptBurst   int
+	idleTimeout   time.Duration
+	writeTimeout  time.Duration
+	keepAlive     time.Duration
+	maxFrameSize  int
+	codec         framing.Codec
+	proxy         *proxyConfig
+	reusePort     int
+	eventLoops    int
+	engine        engine
+
+	tcpInfoInterval time.Duration
+	samplerOnce     sync.Once
+
+	announcer    *discovery.Announcer
+	announceOnce sync.Once
+	stopAnnounce context.CancelFunc
+
+	admitted  int
+	perIP     map[string]*ipState
+	lastSweep time.Time
+	stats     serverStats
+
+	acceptWG sync.WaitGroup
+	connWG   sync.WaitGroup
 }
 
-func NewTCPServer(addr string) *TCPServer {
-	return &TCPServer{
-		ListenAddr:  addr,
-		connections: make(map[net.Conn]bool),
+// NewTCPServer creates a server that passes every line it reads to h.
+// A nil handler falls back to EchoHandler.
+func NewTCPServer(addr string, h Handler, opts ...Option) *TCPServer {
+	if h == nil {
+		h = EchoHandler()
+	}
+	s := &TCPServer{
+		ListenAddr:   addr,
+		handler:      h,
+		connections:  make(map[net.Conn]*ConnContext),
+		perIP:        make(map[string]*ipState),
+		acceptBurst:  1,
+		maxFrameSize: defaultMaxFrameSize,
+		codec:        framing.Newline,
+		ready:        make(chan struct{}),
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
 }
 
 func (s *TCPServer) Start() error {
 	return s.StartWithContext(context.Background())
 }
 
+// StartWithContext listens on ListenAddr and serves until Shutdown is called or ctx is
+// cancelled; see Serve. A "unix://" prefix on ListenAddr listens on a Unix socket.
 func (s *TCPServer) StartWithContext(ctx context.Context) error {
-	lis, err := net.Listen("tcp", s.ListenAddr)
+	network, address := splitNetwork(s.ListenAddr)
+	if s.reusePort > 1 {
+		if network != "tcp" {
+			return fmt.Errorf("reuse-port sharding needs a TCP address, got %q", s.ListenAddr)
+		}
+		listeners, err := s.listenShards(context.Background(), address)
+		if err != nil {
+			return err
+		}
+		return s.serveShards(ctx, listeners)
+	}
+
+	lis, err := net.Listen(network, address)
 	if err != nil {
 		return err
 	}
+	return s.Serve(ctx, lis)
+}
+
+// splitNetwork maps "unix:///path/to/sock" to a Unix socket and anything else to TCP.
+func splitNetwork(addr string) (network, address string) {
+	if path, ok := strings.CutPrefix(addr, "unix://"); ok {
+		return "unix", path
+	}
+	return "tcp", addr
+}
 
+// Serve accepts connections on lis until Shutdown is called or ctx is cancelled, in
+// which case the server drains for up to shutdownTimeout. It returns once every
+// connection goroutine has exited. Serve may be called for several listeners at once;
+// they share connection tracking and limits.
+func (s *TCPServer) Serve(ctx context.Context, lis net.Listener) error {
 	defer lis.Close()
 
-	fmt.Printf("listening on %v\n", s.ListenAddr)
+	if s.eventLoops > 0 {
+		if err := s.startEngine(); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.listeners = append(s.listeners, lis)
+	accepted := new(atomic.Uint64)
+	s.shardAccepts = append(s.shardAccepts, accepted)
+	s.acceptWG.Add(1)
+	s.mu.Unlock()
+	s.readyOnce.Do(func() { close(s.ready) })
+
+	fmt.Printf("listening on %v\n", lis.Addr())
+	if s.announcer != nil {
+		s.announceOnce.Do(func() { s.announce(lis.Addr()) })
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		fmt.Println("Server shutting down...")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		s.Shutdown(shutdownCtx)
+	})
+	defer stop()
+
+	if s.tcpInfoInterval > 0 {
+		s.samplerOnce.Do(func() { go s.sampleTCPInfo(ctx) })
+	}
+
+	err := s.acceptConns(lis, accepted)
+	s.acceptWG.Done()
+	if err != nil {
+		return err
+	}
 
-	s.acceptConns(ctx, lis)
+	s.connWG.Wait()
 	return nil
 }
 
-func (s *TCPServer) acceptConns(ctx context.Context, lis net.Listener) {
-	for {
-		select {
-		case <-ctx.Done():
-			fmt.Println("Server shutting down...")
-			s.closeAllConnections()
-			return
-		default:
+// Shutdown closes the listener, lets every connection finish the line it is handling
+// and then waits for all connection goroutines to exit. If ctx expires first the
+// remaining connections are closed forcibly and ctx.Err() is returned; Shutdown still
+// waits for their goroutines before returning.
+func (s *TCPServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	first := !s.closing
+	s.closing = true
+	listeners := s.listeners
+	if first {
+		if s.stopAnnounce != nil {
+			s.stopAnnounce()
+		}
+		// wake idle readers; busy ones notice closing after their current line
+		for conn := range s.connections {
+			conn.SetReadDeadline(time.Now())
+		}
+	}
+	s.mu.Unlock()
+
+	if first {
+		for _, lis := range listeners {
+			lis.Close()
+		}
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		s.acceptWG.Wait()
+		s.connWG.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		s.closeAllConnections()
+		<-drained
+		return ctx.Err()
+	}
+}
+
+// Ready is closed once the server has a listener, after which Addr is valid.
+func (s *TCPServer) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Addr returns the address of the first listener, which reveals the real port when
+// ListenAddr asked for port 0. It is nil until Ready is closed.
+func (s *TCPServer) Addr() net.Addr {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.listeners) == 0 {
+		return nil
+	}
+	return s.listeners[0].Addr()
+}
+
+// Conns returns the live connections ordered by ID. Connections still reading their
+// PROXY header or completing a TLS handshake are left out until they are established.
+func (s *TCPServer) Conns() []*ConnContext {
+	s.mu.RLock()
+	conns := make([]*ConnContext, 0, len(s.connections))
+	for _, cc := range s.connections {
+		if cc.established.Load() {
+			conns = append(conns, cc)
+		}
+	}
+	s.mu.RUnlock()
+
+	slices.SortFunc(conns, func(a, b *ConnContext) int { return cmp.Compare(a.ID, b.ID) })
+	return conns
+}
+
+// Conn returns the established connection with the given ID.
+func (s *TCPServer) Conn(id uint64) (*ConnContext, bool) {
+	cc, ok := s.lookup(id)
+	if !ok || !cc.established.Load() {
+		return nil, false
+	}
+	return cc, true
+}
+
+// Kick closes the connection with the given ID, reporting whether it was live. It
+// also closes connections that are not yet established.
+func (s *TCPServer) Kick(id uint64) bool {
+	cc, ok := s.lookup(id)
+	if ok {
+		cc.Close()
+	}
+	return ok
+}
+
+func (s *TCPServer) lookup(id uint64) (*ConnContext, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, cc := range s.connections {
+		if cc.ID == id {
+			return cc, true
 		}
+	}
+	return nil, false
+}
+
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
 
+func (s *TCPServer) isClosing() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.closing
+}
+
+// acceptConns serves lis until it is closed. Other Accept errors, such as running out
+// of file descriptors, are retried after a pause that doubles up to maxAcceptDelay, as
+// net/http does.
+func (s *TCPServer) acceptConns(lis net.Listener, accepted *atomic.Uint64) error {
+	var delay time.Duration
+	for {
 		conn, err := lis.Accept()
 		if err != nil {
-			fmt.Printf("accept error: %v\n", err)
+			if s.isClosing() {
+				return nil
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return fmt.Errorf("accept: %w", err)
+			}
+			delay = min(max(2*delay, minAcceptDelay), maxAcceptDelay)
+			fmt.Printf("accept error: %v; retrying in %v\n", err, delay)
+			time.Sleep(delay)
 			continue
 		}
+		delay = 0
+		accepted.Add(1)
+		s.applyKeepAlive(conn)
 
-		s.addConnection(conn)
-		go s.handleConn(conn)
+		cc, err := s.addConnection(conn)
+		if err == ErrServerClosed {
+			conn.Close()
+			continue
+		} else if err != nil {
+			fmt.Printf("refusing connection from %v: %v\n", conn.RemoteAddr(), err)
+			go s.reject(conn, err)
+			continue
+		}
+		// anything the engine will not take, such as a non-socket conn, gets a goroutine
+		if s.engine != nil && s.engine.add(cc) == nil {
+			continue
+		}
+		go s.handleConn(cc)
 	}
 }
 
-func (s *TCPServer) handleConn(conn net.Conn) {
+func (s *TCPServer) handleConn(cc *ConnContext) {
+	conn := cc.raw
 	defer func() {
-		s.removeConnection(conn)
+		s.removeConnection(cc)
 		conn.Close()
+		s.connWG.Done()
 	}()
 
+	if s.proxy != nil {
+		pc, err := s.readProxyHeader(cc, conn)
+		if err != nil {
+			if !s.isClosing() {
+				fmt.Printf("dropping conn %d from %v: %v\n", cc.ID, cc.RemoteAddr, err)
+			}
+			return
+		}
+		conn = pc
+		if err := s.admitConn(cc); err != nil {
+			fmt.Printf("refusing connection from %v: %v\n", cc.RemoteAddr, err)
+			s.reject(conn, err)
+			return
+		}
+	}
+
+	if s.tlsConfig != nil {
+		tlsConn := tls.Server(conn, s.tlsConfig)
+		ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+		err := tlsConn.HandshakeContext(ctx)
+		cancel()
+		if err != nil {
+			fmt.Printf("tls handshake with %v failed: %v\n", cc.RemoteAddr, err)
+			return
+		}
+		state := tlsConn.ConnectionState()
+		cc.TLS = &state
+		cc.PeerIdentity = tlsutil.PeerIdentity(state)
+		conn = tlsConn
+	}
+	cc.setConn(conn)
+	cc.established.Store(true)
+
+	if obs, ok := s.handler.(ConnObserver); ok {
+		obs.OnConnect(cc)
+		defer obs.OnDisconnect(cc)
+	}
+
 	reader := bufio.NewReader(conn)
 	for {
-		data, err := reader.ReadString('\n')
+		if !s.armReadDeadline(conn) {
+			return
+		}
+		msg, err := s.codec.ReadFrame(reader, s.maxFrameSize)
 		if err == io.EOF {
 			return
+		} else if errors.Is(err, framing.ErrFrameTooLarge) {
+			fmt.Printf("conn %d sent a frame over %d bytes, disconnecting\n", cc.ID, s.maxFrameSize)
+			cc.Send([]byte("ERR " + err.Error()))
+			return
 		} else if err != nil {
-			fmt.Println("read error:", err)
+			if s.isClosing() {
+				return
+			}
+			if isTimeout(err) {
+				fmt.Printf("conn %d idle for %v, disconnecting\n", cc.ID, s.idleTimeout)
+			} else {
+				fmt.Println("read error:", err)
+			}
+			return
+		}
+		if err := s.handler.Handle(cc, msg); err != nil {
+			fmt.Printf("handler error on conn %d: %v\n", cc.ID, err)
+			return
+		}
+		if s.isClosing() {
 			return
 		}
-		s.handleData(conn, data)
 	}
 }
 
-func (s *TCPServer) handleData(conn net.Conn, data string) {
-	_, err := conn.Write([]byte("Echo: " + data))
-	if err != nil {
-		fmt.Println("write error:", err)
-	}
-}
+// addConnection registers conn, returning ErrServerClosed if the server is shutting
+// down or the admission error if a connection limit refuses it. With the PROXY
+// protocol, admission waits until handleConn has read the client's real address.
+func (s *TCPServer) addConnection(conn net.Conn) (*ConnContext, error) {
+	ip := remoteIP(conn.RemoteAddr())
 
-func (s *TCPServer) addConnection(conn net.Conn) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.connections[conn] = true
+	if s.closing {
+		return nil, ErrServerClosed
+	}
+	if s.proxy == nil {
+		if err := s.admit(ip); err != nil {
+			return nil, err
+		}
+	}
+
+	cc := newConnContext(s.nextID.Add(1), conn)
+	cc.admittedIP, cc.admitted = ip, s.proxy == nil
+	cc.writeTimeout = s.writeTimeout
+	cc.codec = s.codec
+	s.connections[cc.raw] = cc
+	s.connWG.Add(1)
+	return cc, nil
 }
 
-func (s *TCPServer) removeConnection(conn net.Conn) {
+func (s *TCPServer) removeConnection(cc *ConnContext) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
-	delete(s.connections, conn)
+	_, ok := s.connections[cc.raw]
+	if ok {
+		delete(s.connections, cc.raw)
+		if cc.admitted {
+			s.release(cc.admittedIP)
+		}
+	}
+	s.mu.Unlock()
+
+	if ok {
+		s.logClose(cc)
+	}
 }
 
 func (s *TCPServer) closeAllConnections() {
@@ -105,5 +463,4 @@ func (s *TCPServer) closeAllConnections() {
 	for conn := range s.connections {
 		conn.Close()
 	}
-	s.connections = make(map[net.Conn]bool)
 }
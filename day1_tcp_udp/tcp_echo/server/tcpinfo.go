@@ -0,0 +1,70 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pixperk/bloodsport/day1_tcp_udp/tcpinfo"
+)
+
+// WithTCPInfoInterval samples TCP_INFO for every connection each interval, making the
+// latest sample available from ConnContext.LastTCPInfo. Without it, samples are only
+// taken on demand and when a connection closes. TCP_INFO is only read on Linux.
+func WithTCPInfoInterval(interval time.Duration) Option {
+	return func(s *TCPServer) {
+		s.tcpInfoInterval = interval
+	}
+}
+
+// TCPInfo samples the connection's TCP_INFO now and remembers it as the latest sample.
+func (cc *ConnContext) TCPInfo() (tcpinfo.Info, error) {
+	info, err := tcpinfo.Get(cc.raw)
+	if err != nil {
+		return tcpinfo.Info{}, err
+	}
+	cc.tcpInfo.Store(&info)
+	return info, nil
+}
+
+// LastTCPInfo returns the most recent TCP_INFO sample, if one has been taken.
+func (cc *ConnContext) LastTCPInfo() (tcpinfo.Info, bool) {
+	if info := cc.tcpInfo.Load(); info != nil {
+		return *info, true
+	}
+	return tcpinfo.Info{}, false
+}
+
+// sampleTCPInfo refreshes every connection's sample until the server closes.
+func (s *TCPServer) sampleTCPInfo(ctx context.Context) {
+	ticker := time.NewTicker(s.tcpInfoInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if s.isClosing() {
+			return
+		}
+		for _, cc := range s.Conns() {
+			cc.TCPInfo()
+		}
+	}
+}
+
+// logClose reports a finished connection with a last look at its TCP state. A
+// connection closed from elsewhere, by Kick say, has lost its socket by now, so the
+// latest periodic sample stands in.
+func (s *TCPServer) logClose(cc *ConnContext) {
+	line := fmt.Sprintf("conn %d from %v closed after %v, %d bytes in, %d out",
+		cc.ID, cc.RemoteAddr, time.Since(cc.ConnectedAt).Round(time.Millisecond), cc.BytesIn(), cc.BytesOut())
+	info, err := cc.TCPInfo()
+	if err == nil {
+		line += ", " + info.String()
+	} else if info, ok := cc.LastTCPInfo(); ok {
+		line += ", last sample " + info.String()
+	}
+	fmt.Println(line)
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// WithIdleTimeout closes connections that send nothing for d.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(s *TCPServer) {
+		s.idleTimeout = d
+	}
+}
+
+// WithWriteTimeout fails any single write to a client that takes longer than d.
+func WithWriteTimeout(d time.Duration) Option {
+	return func(s *TCPServer) {
+		s.writeTimeout = d
+	}
+}
+
+// WithKeepAlive sets the TCP keepalive probe period. A negative period disables
+// keepalives; zero keeps the listener's default. It is applied to every accepted
+// TCP connection, so it also holds for listeners handed to Serve.
+func WithKeepAlive(period time.Duration) Option {
+	return func(s *TCPServer) {
+		s.keepAlive = period
+	}
+}
+
+// WithMaxLineLength caps a line, excluding its newline, at n bytes. A client that sends
+// a longer line gets an error reply and is disconnected. It is WithMaxFrameSize under
+// the name that fits the default newline codec.
+func WithMaxLineLength(n int) Option {
+	return WithMaxFrameSize(n)
+}
+
+// armReadDeadline applies the idle timeout before a read. It reports false once the
+// server is closing so the deadline set by Shutdown is never pushed back.
+func (s *TCPServer) armReadDeadline(conn net.Conn) bool {
+	return s.armDeadline(conn, s.idleTimeout)
+}
+
+// armDeadline is armReadDeadline for an arbitrary timeout d; zero means no deadline.
+func (s *TCPServer) armDeadline(conn net.Conn, d time.Duration) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closing {
+		return false
+	}
+	if d > 0 {
+		conn.SetReadDeadline(time.Now().Add(d))
+	} else {
+		conn.SetReadDeadline(time.Time{})
+	}
+	return true
+}
+
+// applyKeepAlive sets the WithKeepAlive period on conn if it is a TCP connection.
+func (s *TCPServer) applyKeepAlive(conn net.Conn) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok || s.keepAlive == 0 {
+		return
+	}
+	if s.keepAlive < 0 {
+		tc.SetKeepAlive(false)
+		return
+	}
+	tc.SetKeepAlive(true)
+	tc.SetKeepAlivePeriod(s.keepAlive)
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
@@ -0,0 +1,178 @@
+package protocol_test
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	protocol "github.com/pixperk/bloodsport/day1_tcp_udp/tcp_multiclient_chat_n_file"
+	"github.com/pixperk/bloodsport/day1_tcp_udp/tcp_multiclient_chat_n_file/server"
+	"github.com/pixperk/bloodsport/day1_tcp_udp/tlsutil"
+)
+
+// startChatServer serves s on a free localhost port until the test ends.
+func startChatServer(t *testing.T, s *server.Server) string {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Serve(ctx, lis)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return lis.Addr().String()
+}
+
+// chatConn is a raw protocol connection to a chat server.
+type chatConn struct {
+	net.Conn
+	dec *json.Decoder
+}
+
+// join connects with cfg and registers as id, returning once the server has
+// announced the registration, or the error that ended the connection instead.
+func join(t *testing.T, addr string, cfg *tls.Config, id string) (*chatConn, error) {
+	t.Helper()
+
+	conn, err := tls.Dial("tcp", addr, cfg)
+	if err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+
+	c := &chatConn{Conn: conn, dec: json.NewDecoder(conn)}
+	hello := protocol.Message{Type: protocol.TypeInitAck, InitAck: &protocol.InitAck{ID: id, Name: id}}
+	if err := json.NewEncoder(conn).Encode(hello); err != nil {
+		return nil, err
+	}
+	for {
+		var msg protocol.Message
+		if err := c.dec.Decode(&msg); err != nil {
+			return nil, err
+		}
+		if msg.Type == protocol.TypeInitAck && msg.InitAck != nil && msg.InitAck.ID == id {
+			return c, nil
+		}
+	}
+}
+
+// waitClosed reads until the server closes c.
+func (c *chatConn) waitClosed() error {
+	for {
+		var msg protocol.Message
+		if err := c.dec.Decode(&msg); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return err
+			}
+			return nil
+		}
+	}
+}
+
+func TestChatMutualTLS(t *testing.T) {
+	ca, err := tlsutil.NewCA("test ca")
+	if err != nil {
+		t.Fatalf("failed to create CA: %v", err)
+	}
+	other, err := tlsutil.NewCA("other ca")
+	if err != nil {
+		t.Fatalf("failed to create CA: %v", err)
+	}
+	issue := func(ca *tlsutil.CA, name string) tls.Certificate {
+		t.Helper()
+		cert, err := ca.Issue(name)
+		if err != nil {
+			t.Fatalf("failed to issue %s cert: %v", name, err)
+		}
+		return cert
+	}
+
+	s := server.NewServer("localhost:0", server.WithTLS(&tls.Config{
+		Certificates: []tls.Certificate{issue(ca, "server")},
+		ClientCAs:    ca.Pool(),
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		MinVersion:   tls.VersionTLS12,
+	}))
+	addr := startChatServer(t, s)
+
+	clientTLS := func(certs ...tls.Certificate) *tls.Config {
+		return &tls.Config{RootCAs: ca.Pool(), Certificates: certs, MinVersion: tls.VersionTLS12}
+	}
+
+	alice, err := join(t, addr, clientTLS(issue(ca, "alice")), "alice")
+	if err != nil {
+		t.Fatalf("Expected alice to join with a certificate for alice: %v", err)
+	}
+	if c, ok := s.Client("alice"); !ok || c.Identity != "alice" {
+		t.Fatalf("Expected alice registered with the certificate identity alice, got %v", ok)
+	}
+
+	if _, err := join(t, addr, clientTLS(issue(ca, "mallory")), "bob"); err == nil {
+		t.Error("Expected a certificate for mallory to be refused the ID bob")
+	}
+	// presented even though the server does not ask for this CA
+	untrusted := issue(other, "eve")
+	forged := clientTLS()
+	forged.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return &untrusted, nil
+	}
+	if _, err := join(t, addr, forged, "eve"); err == nil {
+		t.Error("Expected a certificate from an untrusted CA to be refused")
+	}
+	if _, err := join(t, addr, clientTLS(), "alice"); err == nil {
+		t.Error("Expected a client without a certificate to be refused alice's ID")
+	}
+	if _, err := join(t, addr, clientTLS(), "carol"); err != nil {
+		t.Errorf("Expected a client without a certificate to join under a free ID: %v", err)
+	}
+
+	// the ID is bound only while a client with the certificate holds it
+	alice.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, ok := s.Client("alice"); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected alice to be unregistered once disconnected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := join(t, addr, clientTLS(), "alice"); err != nil {
+		t.Errorf("Expected a client without a certificate to take alice's ID once free: %v", err)
+	}
+
+	// a certificate takes its ID back from a client without one
+	squatter, err := join(t, addr, clientTLS(), "dave")
+	if err != nil {
+		t.Fatalf("Expected a client without a certificate to join as dave: %v", err)
+	}
+	if _, err := join(t, addr, clientTLS(issue(ca, "dave")), "dave"); err != nil {
+		t.Fatalf("Expected dave to join with a certificate for dave: %v", err)
+	}
+	if err := squatter.waitClosed(); err != nil {
+		t.Errorf("Expected the client squatting on dave's ID to be disconnected: %v", err)
+	}
+	deadline = time.Now().Add(2 * time.Second)
+	for {
+		if c, ok := s.Client("dave"); ok && c.Identity == "dave" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected only the dave with a certificate registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
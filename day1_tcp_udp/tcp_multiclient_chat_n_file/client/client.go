@@ -2,23 +2,34 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/pixperk/bloodsport/day1_tcp_udp/discovery"
 	protocol "github.com/pixperk/bloodsport/day1_tcp_udp/tcp_multiclient_chat_n_file"
+	"github.com/pixperk/bloodsport/day1_tcp_udp/tlsutil"
 )
 
+// discoverTimeout bounds the wait for a server announcement with -discover.
+const discoverTimeout = 10 * time.Second
+
 type Client struct {
 	conn               net.Conn
 	id                 string
 	name               string
 	reader             *bufio.Reader
+	tlsConfig          *tls.Config
 	activeFileTransfer map[string]*FileTransfer // key: fromID_fileName
 }
 
@@ -29,12 +40,21 @@ type FileTransfer struct {
 }
 
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("Usage: go run client.go <client_name>")
+	addr := flag.String("addr", "localhost:8080", "server address")
+	discoverGroup := flag.String("discover", "", "find a server announcing on this multicast group instead of using -addr, e.g. "+discovery.DefaultGroup)
+	useTLS := flag.Bool("tls", false, "connect over TLS")
+	caFile := flag.String("ca", "", "CA bundle used to verify the server")
+	certFile := flag.String("cert", "", "client certificate for mutual TLS; its identity becomes the client ID")
+	keyFile := flag.String("key", "", "client key for mutual TLS")
+	insecure := flag.Bool("insecure", false, "skip server certificate verification")
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		fmt.Println("Usage: go run client.go [flags] <client_name>")
 		os.Exit(1)
 	}
 
-	clientName := os.Args[1]
+	clientName := flag.Arg(0)
 	client := &Client{
 		id:                 fmt.Sprintf("client_%s_%d", clientName, os.Getpid()),
 		name:               clientName,
@@ -42,7 +62,43 @@ func main() {
 		activeFileTransfer: make(map[string]*FileTransfer),
 	}
 
-	if err := client.connect("localhost:8080"); err != nil {
+	if *useTLS || *certFile != "" {
+		tlsConfig, err := tlsutil.ClientConfig{
+			CAFile:             *caFile,
+			CertFile:           *certFile,
+			KeyFile:            *keyFile,
+			InsecureSkipVerify: *insecure,
+		}.Build()
+		if err != nil {
+			fmt.Printf("TLS setup failed: %v\n", err)
+			os.Exit(1)
+		}
+		client.tlsConfig = tlsConfig
+
+		// the server binds a certificate to the identity it carries
+		if len(tlsConfig.Certificates) > 0 {
+			leaf, err := x509.ParseCertificate(tlsConfig.Certificates[0].Certificate[0])
+			if err != nil {
+				fmt.Printf("Failed to parse client certificate: %v\n", err)
+				os.Exit(1)
+			}
+			client.id = tlsutil.Identity(leaf)
+		}
+	}
+
+	if *discoverGroup != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), discoverTimeout)
+		found, err := discovery.Find(ctx, *discoverGroup, protocol.ServiceName, discovery.DefaultInterval)
+		cancel()
+		if err != nil {
+			fmt.Printf("Discovery failed: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Found %s server at %s (load %d)\n", found.Service, found.Addr, found.Load)
+		*addr = found.Addr
+	}
+
+	if err := client.connect(*addr); err != nil {
 		fmt.Printf("Failed to connect: %v\n", err)
 		os.Exit(1)
 	}
@@ -60,7 +116,13 @@ func main() {
 }
 
 func (c *Client) connect(addr string) error {
-	conn, err := net.Dial("tcp", addr)
+	var conn net.Conn
+	var err error
+	if c.tlsConfig != nil {
+		conn, err = tls.Dial("tcp", addr, c.tlsConfig)
+	} else {
+		conn, err = net.Dial("tcp", addr)
+	}
 	if err != nil {
 		return err
 	}
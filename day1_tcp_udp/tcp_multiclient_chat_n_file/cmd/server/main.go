@@ -2,33 +2,124 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
+	"net"
 	"os"
 	"os/signal"
+	"slices"
 	"syscall"
+	"time"
 
+	"github.com/pixperk/bloodsport/day1_tcp_udp/admin"
+	"github.com/pixperk/bloodsport/day1_tcp_udp/discovery"
+	protocol "github.com/pixperk/bloodsport/day1_tcp_udp/tcp_multiclient_chat_n_file"
 	"github.com/pixperk/bloodsport/day1_tcp_udp/tcp_multiclient_chat_n_file/server"
+	"github.com/pixperk/bloodsport/day1_tcp_udp/tlsutil"
+	"github.com/pixperk/bloodsport/day1_tcp_udp/upgrade"
 )
 
 func main() {
-	srv := server.NewServer(":8080")
+	addr := flag.String("addr", ":8080", "listen address")
+	certFile := flag.String("cert", "", "TLS certificate file")
+	keyFile := flag.String("key", "", "TLS key file")
+	selfSigned := flag.Bool("self-signed", false, "serve TLS with a generated certificate")
+	clientCA := flag.String("client-ca", "", "CA bundle used to verify client certificates")
+	requireClientCert := flag.Bool("require-client-cert", false, "reject clients without a verified certificate")
+	adminAddr := flag.String("admin", "", "serve the admin HTTP API on this loopback address, e.g. localhost:9100")
+	announceGroup := flag.String("announce", "", "announce the server on this multicast group for discovery, e.g. "+discovery.DefaultGroup)
+	tcpInfoInterval := flag.Duration("tcp-info-interval", 0, "sample TCP_INFO for every connection this often, e.g. 10s (Linux only)")
+	drainTimeout := flag.Duration("drain-timeout", 5*time.Minute, "how long connected clients may stay on the old process after an upgrade")
+	flag.Parse()
+
+	var opts []server.Option
+	if *certFile != "" || *selfSigned {
+		tlsConfig, err := tlsutil.ServerConfig{
+			CertFile:          *certFile,
+			KeyFile:           *keyFile,
+			SelfSigned:        *selfSigned,
+			ClientCAFile:      *clientCA,
+			RequireClientCert: *requireClientCert,
+		}.Build()
+		if err != nil {
+			fmt.Printf("TLS setup failed: %v\n", err)
+			os.Exit(1)
+		}
+		opts = append(opts, server.WithTLS(tlsConfig))
+	}
+	if *tcpInfoInterval > 0 {
+		opts = append(opts, server.WithTCPInfoInterval(*tcpInfoInterval))
+	}
+	if *announceGroup != "" {
+		opts = append(opts, server.WithAnnouncer(discovery.Announcer{Group: *announceGroup, Service: protocol.ServiceName}))
+	}
+
+	srv := server.NewServer(*addr, opts...)
+
+	// listeners are taken in the same order they are handed to upgrade.Upgrade below
+	lis, err := upgrade.Listen("tcp", *addr)
+	if err != nil {
+		fmt.Printf("Server error: %v\n", err)
+		os.Exit(1)
+	}
+	listeners := []net.Listener{lis}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	if *adminAddr != "" {
+		adminLis, err := upgrade.Listen("tcp", *adminAddr)
+		if err != nil {
+			fmt.Printf("admin server error: %v\n", err)
+			os.Exit(1)
+		}
+		listeners = append(listeners, adminLis)
+		go func() {
+			if err := admin.ServeListener(ctx, adminLis, map[string]admin.Target{"chat": admin.Chat(srv)}); err != nil {
+				fmt.Printf("admin server error: %v\n", err)
+			}
+		}()
+	}
+
+	fmt.Printf("Starting TCP chat server on %s...\n", *addr)
+	errs := make(chan error, 1)
+	go func() { errs <- srv.Serve(context.Background(), lis) }()
+	if err := upgrade.Ready(); err != nil {
+		fmt.Printf("failed to notify parent: %v\n", err)
+	}
 
-	go func() {
-		<-sigChan
-		fmt.Println("\nShutdown signal received...")
-		cancel()
-		os.Exit(0)
-	}()
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, append([]os.Signal{syscall.SIGINT, syscall.SIGTERM}, upgradeSignals...)...)
+	for {
+		select {
+		case err := <-errs:
+			if err != nil {
+				fmt.Printf("Server error: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		case sig := <-sigChan:
+			if slices.Contains(upgradeSignals, sig) {
+				child, err := upgrade.Upgrade(listeners...)
+				if err != nil {
+					fmt.Printf("upgrade failed, still serving: %v\n", err)
+					continue
+				}
+				fmt.Printf("handed listeners to pid %d, draining clients\n", child.Pid)
+				// the child serves the admin API now; stop answering on our copy of its listener
+				cancel()
+			} else {
+				fmt.Println("\nShutdown signal received...")
+				srv.Close()
+				return
+			}
 
-	fmt.Println("Starting TCP chat server on :8080...")
-	if err := srv.Start(ctx); err != nil {
-		fmt.Printf("Server error: %v\n", err)
-		os.Exit(1)
+			drainCtx, drainCancel := context.WithTimeout(context.Background(), *drainTimeout)
+			if err := srv.Shutdown(drainCtx); err != nil {
+				fmt.Printf("drain incomplete: %v\n", err)
+			}
+			drainCancel()
+			return
+		}
 	}
 }
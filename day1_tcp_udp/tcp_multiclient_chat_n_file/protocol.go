@@ -2,6 +2,9 @@ package protocol
 
 import "io"
 
+// ServiceName is what chat servers announce themselves as for discovery.
+const ServiceName = "chat"
+
 type MessageType int
 
 const (
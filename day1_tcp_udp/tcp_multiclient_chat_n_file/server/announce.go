@@ -0,0 +1,25 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/pixperk/bloodsport/day1_tcp_udp/discovery"
+)
+
+// WithAnnouncer announces the server on a multicast group while it serves, with the
+// number of registered clients as its load, and withdraws it when it stops.
+func WithAnnouncer(a discovery.Announcer) Option {
+	return func(s *Server) {
+		s.announcer = &a
+	}
+}
+
+// announce runs the announcer for the listener at addr until ctx is done.
+func (s *Server) announce(ctx context.Context, addr net.Addr) {
+	load := func() int { return len(s.Clients()) }
+	if err := s.announcer.Run(ctx, "tcp", addr.String(), load); err != nil {
+		fmt.Printf("announcing %s stopped: %v\n", s.announcer.Service, err)
+	}
+}
@@ -0,0 +1,14 @@
+package server
+
+import "crypto/tls"
+
+type Option func(*Server)
+
+// WithTLS serves TLS using cfg. Clients that present a verified certificate must
+// register with the certificate's identity as their ID, which from then on is closed
+// to clients without one.
+func WithTLS(cfg *tls.Config) Option {
+	return func(s *Server) {
+		s.tlsConfig = cfg
+	}
+}
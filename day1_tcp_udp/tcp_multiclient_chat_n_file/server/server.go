@@ -2,33 +2,108 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/pixperk/bloodsport/day1_tcp_udp/discovery"
 	protocol "github.com/pixperk/bloodsport/day1_tcp_udp/tcp_multiclient_chat_n_file"
+	"github.com/pixperk/bloodsport/day1_tcp_udp/tcpinfo"
+	"github.com/pixperk/bloodsport/day1_tcp_udp/tlsutil"
 )
 
+const handshakeTimeout = 10 * time.Second
+
 type Server struct {
 	ListenAddr string
-
-	mu      sync.RWMutex
-	clients map[*Client]bool
+	tlsConfig  *tls.Config
+
+	mu       sync.RWMutex
+	listener net.Listener
+	closing  bool
+	conns    map[net.Conn]struct{}
+	clients  map[*Client]bool
+	connWG   sync.WaitGroup
+	// certIDs counts the clients registered under each ID with a verified certificate;
+	// while an ID has any, clients without one may not use it.
+	certIDs map[string]int
+
+	tcpInfoInterval time.Duration
+	announcer       *discovery.Announcer
 }
 
 type Client struct {
 	Conn net.Conn
 	ID   string //can also serve as file prefix
 	Name string
+
+	// Identity is the verified client certificate's identity; empty without one.
+	Identity string
+
+	ConnectedAt time.Time
+
+	bytesIn      atomic.Uint64
+	bytesOut     atomic.Uint64
+	lastActivity atomic.Int64
+	tcpInfo      atomic.Pointer[tcpinfo.Info]
+}
+
+// BytesIn and BytesOut count protocol bytes, after any TLS decryption.
+func (c *Client) BytesIn() uint64  { return c.bytesIn.Load() }
+func (c *Client) BytesOut() uint64 { return c.bytesOut.Load() }
+
+// LastActivity is when the client's connection last read or wrote any bytes.
+func (c *Client) LastActivity() time.Time {
+	return time.Unix(0, c.lastActivity.Load())
+}
+
+// meteredConn counts traffic on an accepted connection for its Client.
+type meteredConn struct {
+	net.Conn
+	c *Client
+}
+
+func (m *meteredConn) Read(p []byte) (int, error) {
+	n, err := m.Conn.Read(p)
+	if n > 0 {
+		m.c.bytesIn.Add(uint64(n))
+		m.c.lastActivity.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (m *meteredConn) Write(p []byte) (int, error) {
+	n, err := m.Conn.Write(p)
+	if n > 0 {
+		m.c.bytesOut.Add(uint64(n))
+		m.c.lastActivity.Store(time.Now().UnixNano())
+	}
+	return n, err
 }
 
-func NewServer(listenAddr string) *Server {
-	return &Server{
+// NetConn returns the accepted connection so its socket can be inspected.
+func (m *meteredConn) NetConn() net.Conn {
+	return m.Conn
+}
+
+func NewServer(listenAddr string, opts ...Option) *Server {
+	s := &Server{
 		ListenAddr: listenAddr,
+		conns:      make(map[net.Conn]struct{}),
 		clients:    make(map[*Client]bool),
+		certIDs:    make(map[string]int),
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
+	return s
 }
 
 func (s *Server) Start(ctx context.Context) error {
@@ -36,48 +111,142 @@ func (s *Server) Start(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("failed to listen on %s: %w", s.ListenAddr, err)
 	}
+	return s.Serve(ctx, lis)
+}
 
+// Serve accepts clients on lis until ctx is cancelled, which disconnects everyone, or
+// until Shutdown is called.
+func (s *Server) Serve(ctx context.Context, lis net.Listener) error {
+	if s.tlsConfig != nil {
+		lis = tls.NewListener(lis, s.tlsConfig)
+	}
 	defer lis.Close()
 
-	fmt.Printf("chat and file transfer server listening on %s\n", s.ListenAddr)
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		return nil
+	}
+	s.listener = lis
+	s.mu.Unlock()
+
+	stop := context.AfterFunc(ctx, func() {
+		fmt.Println("Server shutting down...")
+		s.Close()
+	})
+	defer stop()
 
-	s.acceptConns(ctx, lis)
+	if s.tcpInfoInterval > 0 {
+		go s.sampleTCPInfo(ctx)
+	}
 
-	return nil
-}
+	fmt.Printf("chat and file transfer server listening on %s\n", lis.Addr())
+	if s.announcer != nil {
+		announceCtx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go s.announce(announceCtx, lis.Addr())
+	}
 
-func (s *Server) Close() {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	return s.acceptConns(lis)
+}
 
+// Clients returns the registered clients ordered by connect time.
+func (s *Server) Clients() []*Client {
+	s.mu.RLock()
 	clients := make([]*Client, 0, len(s.clients))
 	for c := range s.clients {
 		clients = append(clients, c)
 	}
+	s.mu.RUnlock()
 
-	s.mu.Unlock()
+	slices.SortFunc(clients, func(a, b *Client) int { return a.ConnectedAt.Compare(b.ConnectedAt) })
+	return clients
+}
 
-	for _, c := range clients {
+// Client returns the registered client with the given ID.
+func (s *Server) Client(id string) (*Client, bool) {
+	return s.getClientByID(id)
+}
+
+// Kick disconnects the client with the given ID, reporting whether it was connected.
+func (s *Server) Kick(id string) bool {
+	c, ok := s.getClientByID(id)
+	if ok {
 		c.Conn.Close()
-		s.removeClient(c) // This will acquire its own lock
 	}
+	return ok
 }
 
-func (s *Server) acceptConns(ctx context.Context, lis net.Listener) {
+// Close stops accepting and disconnects every client.
+func (s *Server) Close() {
+	s.mu.Lock()
+	s.closing = true
+	lis := s.listener
+	conns := make([]net.Conn, 0, len(s.conns))
+	for conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	s.mu.Unlock()
+
+	if lis != nil {
+		lis.Close()
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// Shutdown stops accepting and waits for connected clients to leave on their own. If
+// ctx expires first the remaining clients are disconnected and ctx.Err() is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	lis := s.listener
+	s.mu.Unlock()
+	if lis != nil {
+		lis.Close()
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		s.connWG.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		s.Close()
+		<-drained
+		return ctx.Err()
+	}
+}
+
+func (s *Server) acceptConns(lis net.Listener) error {
 	for {
-		select {
-		case <-ctx.Done():
-			fmt.Println("Server shutting down...")
-			s.Close()
-			return
-		default:
-		}
 		conn, err := lis.Accept()
 		if err != nil {
+			s.mu.RLock()
+			closing := s.closing
+			s.mu.RUnlock()
+			if closing || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
 			fmt.Printf("accept error: %v\n", err)
 			continue
 		}
 
+		s.mu.Lock()
+		if s.closing {
+			s.mu.Unlock()
+			conn.Close()
+			continue
+		}
+		s.conns[conn] = struct{}{}
+		s.connWG.Add(1)
+		s.mu.Unlock()
+
 		go s.handleNewConnection(conn)
 	}
 }
@@ -85,15 +254,33 @@ func (s *Server) acceptConns(ctx context.Context, lis net.Listener) {
 func (s *Server) handleNewConnection(conn net.Conn) {
 	//Unique ID and name are generated on the client side
 	client := &Client{
-		Conn: conn,
+		ConnectedAt: time.Now(),
 	}
+	client.lastActivity.Store(client.ConnectedAt.UnixNano())
+	client.Conn = &meteredConn{Conn: conn, c: client}
 
 	defer func() {
+		s.logClose(client)
 		conn.Close()
 		s.removeClient(client)
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		s.connWG.Done()
 	}()
 
-	decoder := json.NewDecoder(conn)
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+		err := tlsConn.HandshakeContext(ctx)
+		cancel()
+		if err != nil {
+			fmt.Printf("tls handshake with %v failed: %v\n", conn.RemoteAddr(), err)
+			return
+		}
+		client.Identity = tlsutil.PeerIdentity(tlsConn.ConnectionState())
+	}
+
+	decoder := json.NewDecoder(client.Conn)
 
 	for {
 		var msg protocol.Message
@@ -103,8 +290,9 @@ func (s *Server) handleNewConnection(conn net.Conn) {
 				fmt.Printf("Client %s disconnected\n", client.ID)
 				return
 			}
+			// the decoder cannot resync after an error, so drop the client
 			fmt.Println("failed to decode message:", err)
-			continue
+			return
 		}
 		s.handleMessage(client, &msg)
 	}
@@ -134,10 +322,20 @@ func (s *Server) handleMessage(client *Client, msg *protocol.Message) {
 }
 
 func (s *Server) handleInitAck(client *Client, initAck *protocol.InitAck) {
+	if client.Identity != "" && initAck.ID != client.Identity {
+		fmt.Printf("Rejecting client %s: certificate is bound to ID %s\n", initAck.ID, client.Identity)
+		client.Conn.Close()
+		return
+	}
+
 	client.ID = initAck.ID
 	client.Name = initAck.Name
 
-	s.addClient(client)
+	if err := s.addClient(client); err != nil {
+		fmt.Printf("Rejecting client %s: %v\n", client.ID, err)
+		client.Conn.Close()
+		return
+	}
 
 	fmt.Printf("Client registered: ID=%s, Name=%s\n", client.ID, client.Name)
 
@@ -262,12 +460,40 @@ func (s *Server) broadcastToAll(msg *protocol.Message) {
 	}
 }
 
-func (s *Server) addClient(c *Client) {
+// addClient registers c under its ID. A client without a certificate may not take an
+// ID held by a client registered with one, and a client registering with a
+// certificate disconnects any client without one that got to its ID first.
+func (s *Server) addClient(c *Client) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if c.Identity == "" {
+		if _, ok := s.certIDs[c.ID]; ok {
+			return fmt.Errorf("ID %s is bound to a client certificate", c.ID)
+		}
+	} else {
+		s.certIDs[c.ID]++
+		for other := range s.clients {
+			if other.ID == c.ID && other.Identity == "" {
+				fmt.Printf("Disconnecting client %s: ID is bound to a client certificate\n", other.ID)
+				other.Conn.Close()
+			}
+		}
+	}
 	s.clients[c] = true
+	return nil
 }
 
+// removeClient unregisters c, freeing its ID once no client with a certificate holds it.
 func (s *Server) removeClient(c *Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.clients[c] {
+		return
+	}
 	delete(s.clients, c)
+	if c.Identity != "" {
+		if s.certIDs[c.ID]--; s.certIDs[c.ID] == 0 {
+			delete(s.certIDs, c.ID)
+		}
+	}
 }
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pixperk/bloodsport/day1_tcp_udp/tcpinfo"
+)
+
+// WithTCPInfoInterval samples TCP_INFO for every registered client each interval,
+// making the latest sample available from Client.LastTCPInfo. TCP_INFO is only read
+// on Linux.
+func WithTCPInfoInterval(interval time.Duration) Option {
+	return func(s *Server) {
+		s.tcpInfoInterval = interval
+	}
+}
+
+// TCPInfo samples the client's TCP_INFO now and remembers it as the latest sample.
+func (c *Client) TCPInfo() (tcpinfo.Info, error) {
+	info, err := tcpinfo.Get(c.Conn)
+	if err != nil {
+		return tcpinfo.Info{}, err
+	}
+	c.tcpInfo.Store(&info)
+	return info, nil
+}
+
+// LastTCPInfo returns the most recent TCP_INFO sample, if one has been taken.
+func (c *Client) LastTCPInfo() (tcpinfo.Info, bool) {
+	if info := c.tcpInfo.Load(); info != nil {
+		return *info, true
+	}
+	return tcpinfo.Info{}, false
+}
+
+func (s *Server) sampleTCPInfo(ctx context.Context) {
+	ticker := time.NewTicker(s.tcpInfoInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.mu.RLock()
+		closing := s.closing
+		s.mu.RUnlock()
+		if closing {
+			return
+		}
+		for _, c := range s.Clients() {
+			c.TCPInfo()
+		}
+	}
+}
+
+// logClose reports a departing client with a last look at its TCP state, falling back
+// to the latest periodic sample once the socket is gone.
+func (s *Server) logClose(c *Client) {
+	line := fmt.Sprintf("Client %s closed after %v, %d bytes in, %d out",
+		c.ID, time.Since(c.ConnectedAt).Round(time.Millisecond), c.BytesIn(), c.BytesOut())
+	info, err := c.TCPInfo()
+	if err == nil {
+		line += ", " + info.String()
+	} else if info, ok := c.LastTCPInfo(); ok {
+		line += ", last sample " + info.String()
+	}
+	fmt.Println(line)
+}
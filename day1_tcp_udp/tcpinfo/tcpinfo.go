@@ -0,0 +1,45 @@
+// Package tcpinfo samples the kernel's TCP_INFO statistics for a connection, which show
+// how the path to a client is behaving: round-trip time, retransmissions and how much
+// data is in flight.
+package tcpinfo
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+type Info struct {
+	RTT    time.Duration `json:"rtt_ns"`
+	RTTVar time.Duration `json:"rtt_var_ns"`
+
+	// Retransmits counts segments retransmitted over the connection's lifetime.
+	Retransmits uint32 `json:"retransmits"`
+	// Cwnd is the congestion window in segments.
+	Cwnd uint32 `json:"cwnd"`
+	// Unacked counts segments sent but not yet acknowledged.
+	Unacked uint32 `json:"unacked"`
+}
+
+func (i Info) String() string {
+	return fmt.Sprintf("rtt=%v rttvar=%v retrans=%d cwnd=%d unacked=%d",
+		i.RTT, i.RTTVar, i.Retransmits, i.Cwnd, i.Unacked)
+}
+
+// Get samples TCP_INFO for conn. Wrappers such as *tls.Conn are looked through via
+// their NetConn method. It returns an error wrapping errors.ErrUnsupported when conn
+// has no socket underneath or the platform has no TCP_INFO.
+func Get(conn net.Conn) (Info, error) {
+	for {
+		if sc, ok := conn.(syscall.Conn); ok {
+			return get(sc)
+		}
+		w, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return Info{}, fmt.Errorf("tcpinfo: %T has no socket: %w", conn, errors.ErrUnsupported)
+		}
+		conn = w.NetConn()
+	}
+}
@@ -0,0 +1,38 @@
+//go:build linux && !386
+
+package tcpinfo
+
+import (
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+func get(sc syscall.Conn) (Info, error) {
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return Info{}, err
+	}
+	var ti syscall.TCPInfo
+	var errno syscall.Errno
+	err = rc.Control(func(fd uintptr) {
+		size := uint32(syscall.SizeofTCPInfo)
+		_, _, errno = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd,
+			syscall.IPPROTO_TCP, syscall.TCP_INFO,
+			uintptr(unsafe.Pointer(&ti)), uintptr(unsafe.Pointer(&size)), 0)
+	})
+	if err != nil {
+		return Info{}, err
+	}
+	if errno != 0 {
+		return Info{}, os.NewSyscallError("getsockopt", errno)
+	}
+	return Info{
+		RTT:         time.Duration(ti.Rtt) * time.Microsecond,
+		RTTVar:      time.Duration(ti.Rttvar) * time.Microsecond,
+		Retransmits: ti.Total_retrans,
+		Cwnd:        ti.Snd_cwnd,
+		Unacked:     ti.Unacked,
+	}, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux || 386
+
+package tcpinfo
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+func get(syscall.Conn) (Info, error) {
+	return Info{}, fmt.Errorf("tcpinfo: TCP_INFO is not available here: %w", errors.ErrUnsupported)
+}
@@ -1,37 +1,62 @@
 package client
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand/v2"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"github.com/pixperk/bloodsport/day1_tcp_udp/udp_echo/wire"
 )
 
+// plainBacklog is how many unframed replies wait for ReceiveMessage before more are
+// dropped, as a full socket buffer would.
+const plainBacklog = 64
+
 type UDPClient struct {
 	SrvAddr string
 	conn    *net.UDPConn
 	timeout time.Duration
 	mu      sync.Mutex
-}
 
-func NewUDPClient(addr string, timeout time.Duration) (*UDPClient, error) {
+	seq     uint32
+	rtt     rttEstimator
+	pending map[wire.Header]chan []byte
+	plain   chan string
+	late    atomic.Uint64
 
-	udpAddr, err := net.ResolveUDPAddr("udp", addr)
-	if err != nil {
-		return nil, err
-	}
+	fragments     *wire.FragmentConfig
+	reassembly    *wire.Reassembler
+	nextMessageID atomic.Uint32
+}
 
-	conn, err := net.DialUDP("udp", nil, udpAddr)
-	if err != nil {
-		return nil, err
-	}
+type Option func(*UDPClient)
 
-	return &UDPClient{
+func NewUDPClient(addr string, timeout time.Duration, opts ...Option) (*UDPClient, error) {
+	c := &UDPClient{
 		SrvAddr: addr,
-		conn:    conn,
 		timeout: timeout,
-	}, nil
+		pending: make(map[wire.Header]chan []byte),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	// like sequence numbers, message IDs must not run into fragments the server still
+	// holds for an earlier client on the same port
+	c.nextMessageID.Store(rand.Uint32())
+	if err := c.Connect(); err != nil {
+		return nil, err
+	}
+	return c, nil
 }
 
+// Connect dials the server, replacing and closing any previous socket.
 func (c *UDPClient) Connect() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -45,24 +70,172 @@ func (c *UDPClient) Connect() error {
 	if err != nil {
 		return err
 	}
+	if c.conn != nil {
+		c.conn.Close()
+	}
 	c.conn = conn
+	c.plain = make(chan string, plainBacklog)
+	go c.readLoop(conn, c.plain)
 	return nil
 }
 
+// Close closes the socket, failing calls still waiting for a reply.
+func (c *UDPClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.Close()
+}
+
 func (c *UDPClient) SendMessage(msg string) error {
-	_, err := c.conn.Write([]byte(msg))
-	return err
+	return c.write([]byte(msg))
 }
 
+// ReceiveMessage returns the next unframed datagram from the server, waiting up to
+// the client's timeout. Replies to Do and SendReliable never show up here.
 func (c *UDPClient) ReceiveMessage() (string, error) {
-	// Set read timeout
-	c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+	c.mu.Lock()
+	plain := c.plain
+	c.mu.Unlock()
 
-	buffer := make([]byte, 1024)
-	n, err := c.conn.Read(buffer)
-	if err != nil {
-		return "", err
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+	select {
+	case msg, ok := <-plain:
+		if !ok {
+			return "", net.ErrClosed
+		}
+		return msg, nil
+	case <-timer.C:
+		return "", os.ErrDeadlineExceeded
+	}
+}
+
+// Do sends payload as a request with its own ID and waits for the server's response
+// carrying the same ID, so concurrent calls each get their own reply. Without a
+// deadline on ctx the client's timeout applies. A response arriving after its call
+// gave up is discarded and counted by LateReplies.
+func (c *UDPClient) Do(ctx context.Context, payload []byte) ([]byte, error) {
+	if _, ok := ctx.Deadline(); !ok && c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
 	}
 
-	return string(buffer[:n]), nil
+	req := wire.Header{Kind: wire.KindRequest, Seq: c.nextSeq()}
+	ch := c.await(wire.Header{Kind: wire.KindResponse, Seq: req.Seq})
+	defer c.forget(wire.Header{Kind: wire.KindResponse, Seq: req.Seq})
+
+	if err := c.write(wire.Append(nil, req, payload)); err != nil {
+		return nil, err
+	}
+	select {
+	case reply, ok := <-ch:
+		if !ok {
+			return nil, net.ErrClosed
+		}
+		return reply, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// LateReplies counts framed replies that arrived when nobody was waiting for them any
+// more: responses to calls that timed out, and duplicates.
+func (c *UDPClient) LateReplies() uint64 {
+	return c.late.Load()
+}
+
+func (c *UDPClient) socket() *net.UDPConn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn
+}
+
+func (c *UDPClient) nextSeq() uint32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.seq == 0 {
+		// a fresh client must not collide with replies the server still caches for
+		// an earlier one on the same port
+		c.seq = rand.Uint32() | 1
+	}
+	c.seq++
+	return c.seq
+}
+
+// await registers interest in the reply with header h.
+func (c *UDPClient) await(h wire.Header) chan []byte {
+	ch := make(chan []byte, 1)
+	c.mu.Lock()
+	c.pending[h] = ch
+	c.mu.Unlock()
+	return ch
+}
+
+func (c *UDPClient) forget(h wire.Header) {
+	c.mu.Lock()
+	delete(c.pending, h)
+	c.mu.Unlock()
+}
+
+// readLoop is the only reader of conn. It hands framed replies to the caller waiting
+// for them and queues everything else for ReceiveMessage.
+func (c *UDPClient) readLoop(conn *net.UDPConn, plain chan string) {
+	defer close(plain)
+	buf := make([]byte, maxDatagram)
+	for {
+		n, err := conn.Read(buf)
+		if errors.Is(err, net.ErrClosed) {
+			c.failPending(conn)
+			return
+		} else if err != nil {
+			// a connected UDP socket reports ICMP errors, such as the server not
+			// listening yet, on the next read; they concern no datagram in particular
+			if !errors.Is(err, syscall.ECONNREFUSED) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			continue
+		}
+
+		c.dispatch(buf[:n], plain)
+	}
+}
+
+// dispatch delivers one whole datagram from the server. It must not keep b.
+func (c *UDPClient) dispatch(b []byte, plain chan string) {
+	h, payload, ok := wire.Parse(b)
+	if !ok {
+		select {
+		case plain <- string(b):
+		default:
+		}
+		return
+	}
+	if h.Kind == wire.KindFragment {
+		c.handleFragment(h, payload, plain)
+		return
+	}
+	c.mu.Lock()
+	ch := c.pending[h]
+	delete(c.pending, h)
+	c.mu.Unlock()
+	if ch == nil {
+		c.late.Add(1)
+		return
+	}
+	ch <- bytes.Clone(payload)
+}
+
+// failPending wakes every caller waiting on conn once it has been closed, unless a
+// new connection has taken over.
+func (c *UDPClient) failPending(conn *net.UDPConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != conn {
+		return
+	}
+	for h, ch := range c.pending {
+		close(ch)
+		delete(c.pending, h)
+	}
 }
@@ -0,0 +1,19 @@
+package client
+
+import (
+	"context"
+	"time"
+
+	"github.com/pixperk/bloodsport/day1_tcp_udp/discovery"
+)
+
+// Discover listens on the multicast group, or discovery.DefaultGroup when group is
+// empty, for the servers' announcement interval and returns a client for the least
+// loaded server announcing service; see discovery.Find.
+func Discover(ctx context.Context, group, service string, interval, timeout time.Duration, opts ...Option) (*UDPClient, error) {
+	s, err := discovery.Find(ctx, group, service, interval)
+	if err != nil {
+		return nil, err
+	}
+	return NewUDPClient(s.Addr, timeout, opts...)
+}
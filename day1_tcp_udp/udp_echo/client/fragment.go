@@ -0,0 +1,55 @@
+package client
+
+import "github.com/pixperk/bloodsport/day1_tcp_udp/udp_echo/wire"
+
+// WithFragmentation splits every datagram longer than cfg.MTU into wire.KindFragment
+// datagrams and reassembles the fragmented replies of a server that does the same. A
+// retransmission by SendReliable sends every fragment again under a new message ID.
+func WithFragmentation(cfg wire.FragmentConfig) Option {
+	return func(c *UDPClient) {
+		cfg = cfg.WithDefaults()
+		c.fragments = &cfg
+		c.reassembly = wire.NewReassembler(cfg)
+	}
+}
+
+// Reassembly reports on the fragmented replies received; it is zero unless
+// fragmentation is enabled.
+func (c *UDPClient) Reassembly() wire.ReassemblyStats {
+	if c.reassembly == nil {
+		return wire.ReassemblyStats{}
+	}
+	return c.reassembly.Stats()
+}
+
+// write sends datagram to the server, in fragments if it is too long for the MTU.
+func (c *UDPClient) write(datagram []byte) error {
+	conn := c.socket()
+	if c.fragments == nil || len(datagram) <= c.fragments.MTU {
+		_, err := conn.Write(datagram)
+		return err
+	}
+	frags, err := wire.Split(datagram, c.nextMessageID.Add(1), c.fragments.MTU)
+	if err != nil {
+		return err
+	}
+	for _, frag := range frags {
+		if _, err := conn.Write(frag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleFragment dispatches the reply a fragment completes. Without fragmentation
+// enabled, fragments are discarded as unexpected replies.
+func (c *UDPClient) handleFragment(h wire.Header, payload []byte, plain chan string) {
+	f, ok := wire.ParseFragment(h, payload)
+	if c.reassembly == nil || !ok {
+		c.late.Add(1)
+		return
+	}
+	if datagram, ok := c.reassembly.Add("", f); ok {
+		c.dispatch(datagram, plain)
+	}
+}
@@ -0,0 +1,123 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/pixperk/bloodsport/day1_tcp_udp/udp_echo/wire"
+)
+
+const (
+	initialRTO = 200 * time.Millisecond
+	minRTO     = 10 * time.Millisecond
+	maxRTO     = 5 * time.Second
+
+	// maxAttempts bounds how often SendReliable transmits one message.
+	maxAttempts = 8
+
+	maxDatagram = 64 * 1024
+)
+
+// ErrUndelivered is returned by SendReliable when no acknowledgement arrived after
+// every retransmission.
+var ErrUndelivered = errors.New("message not acknowledged")
+
+// Delivery reports how a reliable message got through.
+type Delivery struct {
+	Seq   uint32
+	Reply string
+	// Attempts counts transmissions, 1 when nothing was lost.
+	Attempts int
+	// RTT is the time from the last transmission to its acknowledgement.
+	RTT time.Duration
+}
+
+// rttEstimator computes the retransmission timeout from smoothed round-trip samples
+// as in RFC 6298 (Jacobson/Karels).
+type rttEstimator struct {
+	srtt, rttvar time.Duration
+	rto          time.Duration
+}
+
+func (e *rttEstimator) timeout() time.Duration {
+	if e.rto == 0 {
+		return initialRTO
+	}
+	return e.rto
+}
+
+func (e *rttEstimator) sample(rtt time.Duration) {
+	if e.srtt == 0 {
+		e.srtt, e.rttvar = rtt, rtt/2
+	} else {
+		diff := e.srtt - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		e.rttvar = (3*e.rttvar + diff) / 4
+		e.srtt = (7*e.srtt + rtt) / 8
+	}
+	e.rto = min(max(e.srtt+4*e.rttvar, minRTO), maxRTO)
+}
+
+// backoff doubles the timeout after a retransmission.
+func (e *rttEstimator) backoff() {
+	e.rto = min(2*e.timeout(), maxRTO)
+}
+
+// RTO returns the current retransmission timeout.
+func (c *UDPClient) RTO() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rtt.timeout()
+}
+
+// SendReliable sends msg as a sequence-numbered datagram and retransmits it until the
+// server acknowledges it, ctx is done or maxAttempts transmissions went unanswered. The
+// server handles each message once, however often it is retransmitted, and returns its
+// reply in the acknowledgement. It is safe for concurrent use.
+func (c *UDPClient) SendReliable(ctx context.Context, msg string) (Delivery, error) {
+	d := Delivery{Seq: c.nextSeq()}
+	ack := wire.Header{Kind: wire.KindAck, Seq: d.Seq}
+	ch := c.await(ack)
+	defer c.forget(ack)
+	datagram := wire.Append(nil, wire.Header{Kind: wire.KindData, Seq: d.Seq}, []byte(msg))
+
+	for d.Attempts < maxAttempts {
+		d.Attempts++
+		sent := time.Now()
+		if err := c.write(datagram); err != nil {
+			return d, err
+		}
+
+		timer := time.NewTimer(c.RTO())
+		select {
+		case reply, ok := <-ch:
+			timer.Stop()
+			if !ok {
+				return d, net.ErrClosed
+			}
+			d.RTT = time.Since(sent)
+			d.Reply = string(reply)
+			// Karn's algorithm: an ACK after a retransmission cannot be matched to
+			// one transmission, so it says nothing about the RTT
+			if d.Attempts == 1 {
+				c.mu.Lock()
+				c.rtt.sample(d.RTT)
+				c.mu.Unlock()
+			}
+			return d, nil
+		case <-ctx.Done():
+			timer.Stop()
+			return d, ctx.Err()
+		case <-timer.C:
+			c.mu.Lock()
+			c.rtt.backoff()
+			c.mu.Unlock()
+		}
+	}
+	return d, fmt.Errorf("seq %d after %d attempts: %w", d.Seq, d.Attempts, ErrUndelivered)
+}
@@ -0,0 +1,126 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/pixperk/bloodsport/day1_tcp_udp/udp_echo/tftp"
+)
+
+// TFTPClient reads and writes files on a TFTP server (RFC 1350), such as a UDPServer
+// started with WithTFTP. The zero value of every field but Addr takes its default.
+type TFTPClient struct {
+	// Addr is the server's request address, usually on port 69.
+	Addr string
+	// BlockSize asks the server for blocks of this size (RFC 2348) instead of
+	// tftp.DefaultBlockSize. The server may settle on a smaller one.
+	BlockSize int
+	// Mode is tftp.ModeOctet, the default, or tftp.ModeNetASCII for text.
+	Mode string
+	// Timeout and Retries govern retransmission; zero means the tftp package defaults.
+	Timeout time.Duration
+	Retries int
+}
+
+// Get downloads the file called name into w and returns its size.
+func (c *TFTPClient) Get(ctx context.Context, name string, w io.Writer) (int64, error) {
+	tc, opts, err := c.dial()
+	if err != nil {
+		return 0, err
+	}
+
+	var ascii *tftp.NetASCIIWriter
+	if c.mode() == tftp.ModeNetASCII {
+		ascii = tftp.NewNetASCIIWriter(w)
+		w = ascii
+	}
+	rrq := tftp.AppendRequest(nil, tftp.OpRRQ, name, c.mode(), opts)
+	n, err := tc.Receive(ctx, w, rrq, c.negotiator(tc, opts))
+	if err != nil {
+		tc.Close()
+		return n, err
+	}
+	if ascii != nil {
+		err = ascii.Flush()
+	}
+	// the server only learns the transfer succeeded from our last ACK; answer it again
+	// in the background should it be lost
+	go func() {
+		tc.Dally()
+		tc.Close()
+	}()
+	return n, err
+}
+
+// Put uploads r as a new file called name and returns the number of bytes sent.
+func (c *TFTPClient) Put(ctx context.Context, name string, r io.Reader) (int64, error) {
+	tc, opts, err := c.dial()
+	if err != nil {
+		return 0, err
+	}
+	defer tc.Close()
+
+	if c.mode() == tftp.ModeNetASCII {
+		r = tftp.NewNetASCIIReader(r)
+	}
+	wrq := tftp.AppendRequest(nil, tftp.OpWRQ, name, c.mode(), opts)
+	return tc.Send(ctx, r, wrq, c.negotiator(tc, opts))
+}
+
+func (c *TFTPClient) mode() string {
+	if c.Mode == "" {
+		return tftp.ModeOctet
+	}
+	return c.Mode
+}
+
+// dial opens the socket whose port is the client's transfer ID and returns the
+// options to request.
+func (c *TFTPClient) dial() (*tftp.Conn, map[string]string, error) {
+	addr, err := net.ResolveUDPAddr("udp", c.Addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	pc, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	tc := tftp.NewClientConn(pc, addr)
+	tc.Timeout, tc.Retries = c.Timeout, c.Retries
+
+	var opts map[string]string
+	if c.BlockSize != 0 && c.BlockSize != tftp.DefaultBlockSize {
+		if c.BlockSize < tftp.MinBlockSize || c.BlockSize > tftp.MaxBlockSize {
+			pc.Close()
+			return nil, nil, fmt.Errorf("block size %d outside [%d, %d]", c.BlockSize, tftp.MinBlockSize, tftp.MaxBlockSize)
+		}
+		opts = map[string]string{tftp.OptBlockSize: strconv.Itoa(c.BlockSize)}
+	}
+	return tc, opts, nil
+}
+
+// negotiator checks the server's OACK against the options requested.
+func (c *TFTPClient) negotiator(tc *tftp.Conn, opts map[string]string) func(map[string]string) error {
+	if opts == nil {
+		return nil
+	}
+	return func(oack map[string]string) error {
+		for name := range oack {
+			if _, ok := opts[name]; !ok {
+				return fmt.Errorf("server acknowledged option %q, which was not requested", name)
+			}
+		}
+		if v, ok := oack[tftp.OptBlockSize]; ok {
+			size, err := strconv.Atoi(v)
+			if err != nil || size < tftp.MinBlockSize || size > c.BlockSize {
+				return fmt.Errorf("server offered blksize %q for the %d requested", v, c.BlockSize)
+			}
+			tc.BlockSize = size
+		}
+		return nil
+	}
+}
@@ -0,0 +1,122 @@
+// Command tftp serves a directory over TFTP, or fetches and stores files on a TFTP
+// server:
+//
+//	tftp serve [-addr :6969] [-root .] [-writable] [-loss 0.1]
+//	tftp get [-addr localhost:6969] [-blksize 1428] remote [local]
+//	tftp put [-addr localhost:6969] [-blksize 1428] local [remote]
+//
+// SIGINT and SIGTERM stop the server, abandoning transfers in progress.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/pixperk/bloodsport/day1_tcp_udp/udp_echo/client"
+	"github.com/pixperk/bloodsport/day1_tcp_udp/udp_echo/server"
+	"github.com/pixperk/bloodsport/day1_tcp_udp/udp_echo/tftp"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	var err error
+	switch cmd, args := os.Args[1], os.Args[2:]; cmd {
+	case "serve":
+		err = serve(ctx, args)
+	case "get", "put":
+		err = transfer(ctx, cmd, args)
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "tftp: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: tftp serve|get|put [flags] [files]")
+	os.Exit(2)
+}
+
+func serve(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", ":6969", "listen address; the standard port is 69")
+	root := fs.String("root", ".", "directory to serve")
+	writable := fs.Bool("writable", false, "accept uploads of new files")
+	maxBlockSize := fs.Int("max-blksize", 0, "largest block size to agree to, 0 for the protocol maximum")
+	timeout := fs.Duration("timeout", tftp.DefaultTimeout, "retransmission timeout")
+	maxTransfers := fs.Int("max-transfers", server.DefaultMaxTransfers, "transfers in progress at once; more are turned away")
+	loss := fs.Float64("loss", 0, "simulated packet loss on incoming packets, 0 to 1")
+	fs.Parse(args)
+
+	srv := server.NewUDPServer(*addr, server.WithTFTP(server.TFTPConfig{
+		Root:         *root,
+		Writable:     *writable,
+		MaxBlockSize: *maxBlockSize,
+		Timeout:      *timeout,
+		MaxTransfers: *maxTransfers,
+	}))
+	srv.SetPacketLoss(*loss)
+	go func() {
+		<-srv.Ready()
+		fmt.Printf("serving %s over TFTP on %v\n", *root, srv.Addr())
+	}()
+	return srv.Start(ctx)
+}
+
+func transfer(ctx context.Context, cmd string, args []string) error {
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	addr := fs.String("addr", "localhost:6969", "server address")
+	blockSize := fs.Int("blksize", 0, "block size to ask for, 0 for the standard 512 bytes")
+	mode := fs.String("mode", tftp.ModeOctet, "transfer mode: octet or netascii")
+	timeout := fs.Duration("timeout", tftp.DefaultTimeout, "retransmission timeout")
+	fs.Parse(args)
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		usage()
+	}
+	from, to := fs.Arg(0), fs.Arg(1)
+	if to == "" {
+		to = filepath.Base(from)
+	}
+
+	c := &client.TFTPClient{Addr: *addr, BlockSize: *blockSize, Mode: *mode, Timeout: *timeout}
+	start := time.Now()
+	var n int64
+	if cmd == "get" {
+		f, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if err != nil {
+			return err
+		}
+		n, err = c.Get(ctx, from, f)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(to)
+			return err
+		}
+	} else {
+		f, err := os.Open(from)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if n, err = c.Put(ctx, to, f); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("%s %s -> %s: %d bytes in %v\n", cmd, from, to, n, time.Since(start).Round(time.Millisecond))
+	return nil
+}
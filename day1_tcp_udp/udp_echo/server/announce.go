@@ -0,0 +1,24 @@
+package server
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pixperk/bloodsport/day1_tcp_udp/discovery"
+)
+
+// WithAnnouncer announces the server on a multicast group while it runs, with the
+// number of recently seen peers as its load, and withdraws it on Close.
+func WithAnnouncer(a discovery.Announcer) Option {
+	return func(s *UDPServer) {
+		s.announcer = &a
+	}
+}
+
+// announce runs the announcer for the bound socket until ctx is done.
+func (s *UDPServer) announce(ctx context.Context) {
+	load := func() int { return len(s.Peers()) }
+	if err := s.announcer.Run(ctx, "udp", s.Addr().String(), load); err != nil {
+		fmt.Printf("announcing %s stopped: %v\n", s.announcer.Service, err)
+	}
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/pixperk/bloodsport/day1_tcp_udp/udp_echo/wire"
+)
+
+// WithFragmentation reassembles messages that clients split into wire.KindFragment
+// datagrams and splits every reply longer than cfg.MTU the same way, so messages of
+// many kilobytes can cross a path that only carries small datagrams. Clients of such
+// a server must reassemble fragments too.
+func WithFragmentation(cfg wire.FragmentConfig) Option {
+	return func(s *UDPServer) {
+		cfg = cfg.WithDefaults()
+		s.fragments = &cfg
+		s.reassembly = wire.NewReassembler(cfg)
+	}
+}
+
+// handleFragment adds a fragment to its message and handles the message once it is
+// whole. Without fragmentation enabled fragments are dropped: unlike datagrams of an
+// unknown kind they are not echoed back as plain messages, since a fragment's peer
+// expects framed replies.
+func (s *UDPServer) handleFragment(h wire.Header, payload []byte, clientAddr *net.UDPAddr) {
+	if s.fragments == nil {
+		return
+	}
+	f, ok := wire.ParseFragment(h, payload)
+	if !ok {
+		return
+	}
+	if datagram, ok := s.reassembly.Add(clientAddr.String(), f); ok {
+		s.handleDatagram(datagram, clientAddr)
+	}
+}
+
+// replyFragmented sends b as fragments under a fresh message ID.
+func (s *UDPServer) replyFragmented(b []byte, clientAddr *net.UDPAddr) {
+	frags, err := wire.Split(b, s.nextMessageID.Add(1), s.fragments.MTU)
+	if err != nil {
+		fmt.Printf("Reply of %d bytes to %v not sent: %v\n", len(b), clientAddr, err)
+		return
+	}
+	for _, frag := range frags {
+		n, err := s.out.WriteTo(frag, clientAddr)
+		if err != nil {
+			return
+		}
+		s.track(clientAddr, n, true)
+	}
+}
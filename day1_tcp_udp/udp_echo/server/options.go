@@ -0,0 +1,53 @@
+package server
+
+import "github.com/pixperk/bloodsport/day1_tcp_udp/netem"
+
+// maxDatagramSize is the largest UDP payload; WithMaxDatagramSize is capped to it.
+const maxDatagramSize = 64 * 1024
+
+const (
+	defaultMaxDatagramSize = 8 * 1024
+	defaultQueueSize       = 1024
+)
+
+type Option func(*UDPServer)
+
+// WithMaxDatagramSize sizes receive buffers for datagrams of up to n bytes, at most
+// 64KiB. Longer datagrams are cut to n bytes and counted in Stats.Truncated. The
+// default is 8KiB.
+func WithMaxDatagramSize(n int) Option {
+	return func(s *UDPServer) {
+		if n > 0 {
+			s.maxDatagramSize = min(n, maxDatagramSize)
+		}
+	}
+}
+
+// WithWorkers handles packets on n worker goroutines. The default is GOMAXPROCS.
+func WithWorkers(n int) Option {
+	return func(s *UDPServer) {
+		if n > 0 {
+			s.workers = n
+		}
+	}
+}
+
+// WithQueueSize lets up to n received packets wait for a worker. Packets that arrive
+// while the queue is full are dropped and counted in Stats.QueueFull. The default is
+// 1024.
+func WithQueueSize(n int) Option {
+	return func(s *UDPServer) {
+		if n > 0 {
+			s.queueSize = n
+		}
+	}
+}
+
+// WithImpairment sends replies through a netem link configured by cfg, so clients can
+// be tested against loss, delay, duplication, reordering and corruption. Unlike
+// SetPacketLoss, which drops requests before they are handled, this impairs the replies.
+func WithImpairment(cfg netem.Config) Option {
+	return func(s *UDPServer) {
+		s.impairment = &cfg
+	}
+}
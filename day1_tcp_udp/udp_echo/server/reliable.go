@@ -0,0 +1,107 @@
+package server
+
+import (
+	"container/list"
+	"net"
+	"time"
+
+	"github.com/pixperk/bloodsport/day1_tcp_udp/udp_echo/wire"
+)
+
+// handleFramed answers a framed datagram according to its kind. Requests are echoed
+// under their own ID; acks and responses are ignored. Unknown kinds never get here, as
+// wire.Parse takes them for plain messages.
+func (s *UDPServer) handleFramed(h wire.Header, payload []byte, clientAddr *net.UDPAddr) {
+	switch h.Kind {
+	case wire.KindData:
+		s.handleReliable(h, payload, clientAddr)
+	case wire.KindRequest:
+		s.reply(wire.Append(nil, wire.Header{Kind: wire.KindResponse, Seq: h.Seq}, echo(payload)), clientAddr)
+	case wire.KindFragment:
+		s.handleFragment(h, payload, clientAddr)
+	}
+}
+
+// dedupeWindow is how many recent replies the server keeps per peer to answer
+// retransmissions without handling the message again.
+const dedupeWindow = 256
+
+// dedupeMaxBytes caps the replies kept for all peers together. The peers heard from
+// least recently give up their oldest replies first.
+const dedupeMaxBytes = 16 << 20
+
+// recentReplies remembers the replies sent to one peer's reliable messages.
+type recentReplies struct {
+	key      string
+	replies  map[uint32][]byte
+	order    []uint32
+	size     int
+	lastSeen time.Time
+	elem     *list.Element // in UDPServer.reliableLRU
+}
+
+// dropOldest forgets r's oldest reply and returns its size.
+func (r *recentReplies) dropOldest() int {
+	n := len(r.replies[r.order[0]])
+	delete(r.replies, r.order[0])
+	r.order = r.order[1:]
+	r.size -= n
+	return n
+}
+
+// handleReliable answers a KindData datagram with a KindAck carrying the echo. A
+// retransmission of a message already handled gets the same ACK again, so each
+// message is handled at most once however many of its ACKs are lost.
+func (s *UDPServer) handleReliable(h wire.Header, payload []byte, clientAddr *net.UDPAddr) {
+	now := time.Now()
+	key := clientAddr.String()
+
+	s.reliableMu.Lock()
+	// the least recently heard from peers are at the back
+	for back := s.reliableLRU.Back(); back != nil; back = s.reliableLRU.Back() {
+		stale := back.Value.(*recentReplies)
+		if now.Sub(stale.lastSeen) <= peerTTL {
+			break
+		}
+		s.forgetReliable(stale)
+	}
+	r := s.reliable[key]
+	if r == nil {
+		r = &recentReplies{key: key, replies: make(map[uint32][]byte)}
+		r.elem = s.reliableLRU.PushFront(r)
+		s.reliable[key] = r
+	} else {
+		s.reliableLRU.MoveToFront(r.elem)
+	}
+	r.lastSeen = now
+	reply, dup := r.replies[h.Seq]
+	if dup {
+		s.stats.duplicates.Add(1)
+	} else {
+		reply = wire.Append(nil, wire.Header{Kind: wire.KindAck, Seq: h.Seq}, echo(payload))
+		r.replies[h.Seq] = reply
+		r.order = append(r.order, h.Seq)
+		r.size += len(reply)
+		s.reliableBytes += len(reply)
+		if len(r.order) > dedupeWindow {
+			s.reliableBytes -= r.dropOldest()
+		}
+		for s.reliableBytes > dedupeMaxBytes {
+			lru := s.reliableLRU.Back().Value.(*recentReplies)
+			s.reliableBytes -= lru.dropOldest()
+			if len(lru.order) == 0 {
+				s.forgetReliable(lru)
+			}
+		}
+	}
+	s.reliableMu.Unlock()
+
+	s.reply(reply, clientAddr)
+}
+
+// forgetReliable drops every reply kept for r's peer. The caller holds reliableMu.
+func (s *UDPServer) forgetReliable(r *recentReplies) {
+	s.reliableBytes -= r.size
+	s.reliableLRU.Remove(r.elem)
+	delete(s.reliable, r.key)
+}
@@ -1,29 +1,240 @@
 package server
 
 import (
+	"container/list"
 	"context"
+	"errors"
 	"fmt"
 	"math/rand/v2"
 	"net"
+	"runtime"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pixperk/bloodsport/day1_tcp_udp/discovery"
+	"github.com/pixperk/bloodsport/day1_tcp_udp/netem"
+	"github.com/pixperk/bloodsport/day1_tcp_udp/udp_echo/wire"
 )
 
+// ErrServerClosed is returned by Start after Close.
+var ErrServerClosed = errors.New("udp server closed")
+
+// peerTTL is how long a silent peer stays in the table reported by Peers.
+const peerTTL = 5 * time.Minute
+
 type UDPServer struct {
 	ListenAddr string
 	conn       *net.UDPConn
+	out        net.PacketConn // replies go here: conn, or conn behind an impairment
+	impairment *netem.Config
+	announcer  *discovery.Announcer
 
 	mu         sync.RWMutex
+	started    bool
 	running    bool
+	closing    bool
+	ready      chan struct{}
+	stopped    chan struct{}
 	packetLoss float64 // 0.0 to 1.0 (0% to 100% loss)
+
+	peersMu   sync.Mutex
+	peers     map[string]*Peer
+	lastSweep time.Time
+
+	maxDatagramSize int
+	workers         int
+	queueSize       int
+	queue           chan packet
+	bufs            sync.Pool
+	stats           serverStats
+
+	reliableMu    sync.Mutex
+	reliable      map[string]*recentReplies
+	reliableLRU   *list.List // of *recentReplies, most recently heard from first
+	reliableBytes int
+
+	fragments     *wire.FragmentConfig
+	reassembly    *wire.Reassembler
+	nextMessageID atomic.Uint32
+
+	tftp          *TFTPConfig
+	tftpStats     tftpStats
+	tftpSlots     chan struct{} // holds a token per transfer in progress
+	transfers     sync.WaitGroup
+	transferCtx   context.Context
+	stopTransfers context.CancelFunc
+	transferSeq   atomic.Uint64
+}
+
+// packet is a received datagram waiting for a worker; buf goes back to the pool once
+// it has been handled.
+type packet struct {
+	buf  *[]byte
+	n    int
+	addr *net.UDPAddr
+}
+
+// Stats counts received packets and the ones the server could not handle in full.
+type Stats struct {
+	Received uint64
+	// Truncated counts datagrams longer than the max datagram size, which were
+	// handled cut short.
+	Truncated uint64
+	// QueueFull counts packets dropped because every worker was busy and the queue
+	// was full; QueueLen and QueueCap show how close the queue is to that now.
+	QueueFull uint64
+	QueueLen  int
+	QueueCap  int
+	// Duplicates counts retransmitted reliable messages answered from the reply
+	// cache rather than handled again.
+	Duplicates uint64
+	// Reassembly is zero unless fragmentation is enabled.
+	Reassembly wire.ReassemblyStats
+	// TFTP is zero unless the server serves TFTP.
+	TFTP TFTPStats
+}
+
+type serverStats struct {
+	received   atomic.Uint64
+	truncated  atomic.Uint64
+	queueFull  atomic.Uint64
+	duplicates atomic.Uint64
+}
+
+// Peer is the traffic seen from one client address.
+type Peer struct {
+	Addr       *net.UDPAddr
+	FirstSeen  time.Time
+	LastSeen   time.Time
+	PacketsIn  uint64
+	PacketsOut uint64
+	BytesIn    uint64
+	BytesOut   uint64
+}
+
+func NewUDPServer(addr string, opts ...Option) *UDPServer {
+	s := &UDPServer{
+		ListenAddr:      addr,
+		peers:           make(map[string]*Peer),
+		reliable:        make(map[string]*recentReplies),
+		reliableLRU:     list.New(),
+		maxDatagramSize: defaultMaxDatagramSize,
+		workers:         runtime.GOMAXPROCS(0),
+		queueSize:       defaultQueueSize,
+		ready:           make(chan struct{}),
+		stopped:         make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.transferCtx, s.stopTransfers = context.WithCancel(context.Background())
+	// one spare byte tells a datagram that exactly fits from one that was cut
+	s.bufs.New = func() any {
+		b := make([]byte, s.maxDatagramSize+1)
+		return &b
+	}
+	s.queue = make(chan packet, s.queueSize)
+	return s
+}
+
+func (s *UDPServer) Stats() Stats {
+	var reassembly wire.ReassemblyStats
+	if s.reassembly != nil {
+		reassembly = s.reassembly.Stats()
+	}
+	return Stats{
+		Received:  s.stats.received.Load(),
+		Truncated: s.stats.truncated.Load(),
+		QueueFull: s.stats.queueFull.Load(),
+		QueueLen:  len(s.queue),
+		QueueCap:  cap(s.queue),
+
+		Duplicates: s.stats.duplicates.Load(),
+		Reassembly: reassembly,
+		TFTP:       s.tftpStatsSnapshot(),
+	}
 }
 
-func NewUDPServer(addr string) *UDPServer {
-	return &UDPServer{
-		ListenAddr: addr,
+// PacketLoss returns the simulated loss probability.
+func (s *UDPServer) PacketLoss() float64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.packetLoss
+}
+
+// SetPacketLoss drops each incoming packet with probability p, clamped to [0, 1].
+func (s *UDPServer) SetPacketLoss(p float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.packetLoss = min(max(p, 0), 1)
+}
+
+// Peers returns the clients heard from within the last peerTTL, most recent first.
+func (s *UDPServer) Peers() []Peer {
+	s.peersMu.Lock()
+	peers := make([]Peer, 0, len(s.peers))
+	for _, p := range s.peers {
+		if time.Since(p.LastSeen) <= peerTTL {
+			peers = append(peers, *p)
+		}
+	}
+	s.peersMu.Unlock()
+
+	slices.SortFunc(peers, func(a, b Peer) int { return b.LastSeen.Compare(a.LastSeen) })
+	return peers
+}
+
+// track records a packet of n bytes from addr, or a reply of n bytes to it when out
+// is set, and forgets peers that have been silent for peerTTL.
+func (s *UDPServer) track(addr *net.UDPAddr, n int, out bool) {
+	now := time.Now()
+	key := addr.String()
+
+	s.peersMu.Lock()
+	defer s.peersMu.Unlock()
+	if now.Sub(s.lastSweep) > peerTTL {
+		for k, p := range s.peers {
+			if now.Sub(p.LastSeen) > peerTTL {
+				delete(s.peers, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	p := s.peers[key]
+	if p == nil {
+		p = &Peer{Addr: addr, FirstSeen: now}
+		s.peers[key] = p
+	}
+	p.LastSeen = now
+	if out {
+		p.PacketsOut++
+		p.BytesOut += uint64(n)
+	} else {
+		p.PacketsIn++
+		p.BytesIn += uint64(n)
 	}
 }
 
+// Start listens on ListenAddr and serves until ctx is cancelled or Close is called,
+// returning once every packet already received has been handled and the socket is
+// closed. A server can only be started once.
 func (s *UDPServer) Start(ctx context.Context) error {
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	if s.started {
+		s.mu.Unlock()
+		return errors.New("server already started")
+	}
+	s.started = true
+	s.mu.Unlock()
+	defer close(s.stopped)
+
 	addr, err := net.ResolveUDPAddr("udp", s.ListenAddr)
 	if err != nil {
 		return err
@@ -35,29 +246,133 @@ func (s *UDPServer) Start(ctx context.Context) error {
 	}
 
 	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		conn.Close()
+		return nil
+	}
 	s.conn = conn
+	s.out = conn
+	if s.impairment != nil {
+		s.out = netem.NewPacketConn(conn, *s.impairment)
+	}
 	s.running = true
 	s.mu.Unlock()
+	close(s.ready)
+
+	stop := context.AfterFunc(ctx, func() { s.Close() })
+	defer stop()
+
+	if s.announcer != nil {
+		announceCtx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go s.announce(announceCtx)
+	}
+
+	var wg sync.WaitGroup
+	for range s.workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.work()
+		}()
+	}
 
 	//single goroutine reads all packets
-	return s.listen(ctx)
+	err = s.listen()
+
+	// workers reply to what is queued before the socket goes away
+	close(s.queue)
+	wg.Wait()
+	s.stopTransfers()
+	s.transfers.Wait()
+	s.out.Close()
+
+	s.mu.Lock()
+	s.running = false
+	s.mu.Unlock()
+	return err
 }
 
-func (s *UDPServer) listen(ctx context.Context) error {
-	buf := make([]byte, 1024)
-	for {
-		select {
-		case <-ctx.Done():
-			return nil
-		default:
-		}
+// Close stops reading, lets the workers finish the packets already received, closes
+// the socket and waits for Start to return. It is safe to call more than once.
+func (s *UDPServer) Close() error {
+	s.mu.Lock()
+	s.closing = true
+	started, conn := s.started, s.conn
+	s.mu.Unlock()
+	if !started {
+		return nil
+	}
+	if conn != nil {
+		// wake the reader without closing the socket under the workers
+		conn.SetReadDeadline(time.Now())
+	}
+	<-s.stopped
+	return nil
+}
 
-		n, clientAddr, err := s.conn.ReadFromUDP(buf)
+// Ready is closed once the socket is bound, after which Addr is valid.
+func (s *UDPServer) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Addr returns the bound address, which reveals the real port when ListenAddr asked
+// for port 0. It is nil until Ready is closed.
+func (s *UDPServer) Addr() net.Addr {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.LocalAddr()
+}
+
+// Running reports whether the server is bound and serving.
+func (s *UDPServer) Running() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.running
+}
+
+func (s *UDPServer) isClosing() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.closing
+}
+
+func (s *UDPServer) listen() error {
+	for {
+		buf := s.bufs.Get().(*[]byte)
+		n, clientAddr, err := s.conn.ReadFromUDP(*buf)
 		if err != nil {
+			s.bufs.Put(buf)
+			if s.isClosing() {
+				return nil
+			}
 			return err
 		}
+		s.stats.received.Add(1)
+		if n > s.maxDatagramSize {
+			s.stats.truncated.Add(1)
+			fmt.Printf("Datagram from %v exceeds %d bytes, truncated\n", clientAddr, s.maxDatagramSize)
+			n = s.maxDatagramSize
+		}
+		s.track(clientAddr, n, false)
+
+		select {
+		case s.queue <- packet{buf: buf, n: n, addr: clientAddr}:
+		default:
+			s.stats.queueFull.Add(1)
+			s.bufs.Put(buf)
+		}
+	}
+}
 
-		go s.handlePacket(buf[:n], clientAddr)
+func (s *UDPServer) work() {
+	for p := range s.queue {
+		s.handlePacket((*p.buf)[:p.n], p.addr)
+		s.bufs.Put(p.buf)
 	}
 }
 
@@ -78,7 +393,33 @@ func (s *UDPServer) handlePacket(data []byte, clientAddr *net.UDPAddr) {
 		fmt.Printf("Simulated packet loss from %v\n", clientAddr)
 		return
 	}
+	s.handleDatagram(data, clientAddr)
+}
+
+// handleDatagram answers one whole message, whether it arrived in a single datagram
+// or was reassembled from fragments.
+func (s *UDPServer) handleDatagram(data []byte, clientAddr *net.UDPAddr) {
+	if s.tftp != nil {
+		s.handleTFTPRequest(data, clientAddr)
+		return
+	}
+	if h, payload, ok := wire.Parse(data); ok {
+		s.handleFramed(h, payload, clientAddr)
+		return
+	}
+	s.reply(echo(data), clientAddr)
+}
+
+func echo(data []byte) []byte {
+	return append([]byte("ECHO : "), data...)
+}
 
-	response := "ECHO : " + string(data)
-	s.conn.WriteToUDP([]byte(response), clientAddr)
+func (s *UDPServer) reply(b []byte, clientAddr *net.UDPAddr) {
+	if s.fragments != nil && len(b) > s.fragments.MTU {
+		s.replyFragmented(b, clientAddr)
+		return
+	}
+	if n, err := s.out.WriteTo(b, clientAddr); err == nil {
+		s.track(clientAddr, n, true)
+	}
 }
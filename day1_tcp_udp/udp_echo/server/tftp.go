@@ -0,0 +1,323 @@
+package server
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pixperk/bloodsport/day1_tcp_udp/netem"
+	"github.com/pixperk/bloodsport/day1_tcp_udp/udp_echo/tftp"
+)
+
+// TFTPConfig describes the files a TFTP server serves.
+type TFTPConfig struct {
+	// Root is the directory served; requests cannot reach outside it, symbolic links
+	// included.
+	Root string
+	// Writable accepts write requests. They only create files: an existing file is
+	// never overwritten, and an upload that fails leaves nothing behind.
+	Writable bool
+	// MaxBlockSize caps the blksize option; zero means tftp.MaxBlockSize.
+	MaxBlockSize int
+	// Timeout and Retries govern retransmission; zero means the tftp package defaults.
+	Timeout time.Duration
+	Retries int
+	// MaxTransfers caps the transfers in progress at once; zero means
+	// DefaultMaxTransfers. Requests beyond it are answered with an ERROR.
+	MaxTransfers int
+}
+
+const DefaultMaxTransfers = 64
+
+// TFTPStats counts finished TFTP transfers.
+type TFTPStats struct {
+	Reads  uint64
+	Writes uint64
+	// Failed counts transfers that ended in an error, sent or received, or a timeout.
+	Failed      uint64
+	Retransmits uint64
+	// Busy counts requests turned away because MaxTransfers were in progress.
+	Busy uint64
+}
+
+type tftpStats struct {
+	reads       atomic.Uint64
+	writes      atomic.Uint64
+	failed      atomic.Uint64
+	retransmits atomic.Uint64
+	busy        atomic.Uint64
+}
+
+// WithTFTP serves files under cfg.Root over TFTP (RFC 1350) instead of echoing. Each
+// transfer runs on a socket of its own, as the protocol requires, to which the
+// simulated packet loss and WithImpairment apply as they do to the request socket.
+// Close abandons transfers in progress.
+func WithTFTP(cfg TFTPConfig) Option {
+	return func(s *UDPServer) {
+		s.tftp = &cfg
+		s.tftpSlots = make(chan struct{}, cmp.Or(cfg.MaxTransfers, DefaultMaxTransfers))
+	}
+}
+
+func (s *UDPServer) tftpStatsSnapshot() TFTPStats {
+	return TFTPStats{
+		Reads:       s.tftpStats.reads.Load(),
+		Writes:      s.tftpStats.writes.Load(),
+		Failed:      s.tftpStats.failed.Load(),
+		Retransmits: s.tftpStats.retransmits.Load(),
+		Busy:        s.tftpStats.busy.Load(),
+	}
+}
+
+// handleTFTPRequest starts a transfer for a RRQ or WRQ on the request socket.
+func (s *UDPServer) handleTFTPRequest(data []byte, clientAddr *net.UDPAddr) {
+	p, err := tftp.Parse(data)
+	if err != nil || (p.Op != tftp.OpRRQ && p.Op != tftp.OpWRQ) {
+		s.reply(tftp.AppendError(nil, &tftp.Error{Code: tftp.ErrIllegalOp, Message: "expected a read or write request"}), clientAddr)
+		return
+	}
+	select {
+	case s.tftpSlots <- struct{}{}:
+	default:
+		s.tftpStats.busy.Add(1)
+		s.reply(tftp.AppendError(nil, &tftp.Error{Code: tftp.ErrUndefined, Message: "too many transfers in progress, try again later"}), clientAddr)
+		return
+	}
+	s.transfers.Add(1)
+	go func() {
+		defer s.transfers.Done()
+		defer func() { <-s.tftpSlots }()
+		s.serveTransfer(p, clientAddr)
+	}()
+}
+
+// lossyConn applies the server's simulated packet loss to what a transfer socket reads.
+type lossyConn struct {
+	net.PacketConn
+	s *UDPServer
+}
+
+func (c *lossyConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil || !c.s.simulatePacketLoss() {
+			return n, addr, err
+		}
+	}
+}
+
+func (s *UDPServer) serveTransfer(req tftp.Packet, clientAddr *net.UDPAddr) {
+	// the transfer's own port on the address the request came in on
+	local := &net.UDPAddr{IP: s.conn.LocalAddr().(*net.UDPAddr).IP}
+	pc, err := net.ListenUDP("udp", local)
+	if err != nil {
+		fmt.Printf("TFTP transfer for %v not started: %v\n", clientAddr, err)
+		return
+	}
+	var conn net.PacketConn = &lossyConn{PacketConn: pc, s: s}
+	if s.impairment != nil {
+		cfg := *s.impairment
+		cfg.Seed += s.transferSeq.Add(1)
+		conn = netem.NewPacketConn(conn, cfg)
+	}
+	tc := tftp.NewServerConn(conn, clientAddr)
+	tc.Timeout, tc.Retries = s.tftp.Timeout, s.tftp.Retries
+	defer tc.Close()
+
+	var n int64
+	switch req.Op {
+	case tftp.OpRRQ:
+		n, err = s.serveRead(tc, req)
+		s.tftpStats.reads.Add(1)
+	case tftp.OpWRQ:
+		n, err = s.serveWrite(tc, req)
+		s.tftpStats.writes.Add(1)
+	}
+	s.tftpStats.retransmits.Add(uint64(tc.Retransmits()))
+	if err != nil {
+		s.tftpStats.failed.Add(1)
+		fmt.Printf("TFTP %s of %q for %v failed after %d bytes: %v\n", opName(req.Op), req.Filename, clientAddr, n, err)
+		return
+	}
+	fmt.Printf("TFTP %s of %q for %v: %d bytes, %d retransmits\n", opName(req.Op), req.Filename, clientAddr, n, tc.Retransmits())
+}
+
+func opName(op tftp.Opcode) string {
+	if op == tftp.OpWRQ {
+		return "write"
+	}
+	return "read"
+}
+
+// negotiate validates the request's mode and settles its options, returning the OACK
+// to send, or nil when there is nothing to acknowledge.
+func (s *UDPServer) negotiate(tc *tftp.Conn, req tftp.Packet) ([]byte, *tftp.Error) {
+	if req.Mode != tftp.ModeOctet && req.Mode != tftp.ModeNetASCII {
+		return nil, &tftp.Error{Code: tftp.ErrIllegalOp, Message: "unsupported mode " + req.Mode}
+	}
+	v, ok := req.Options[tftp.OptBlockSize]
+	if !ok {
+		return nil, nil
+	}
+	size, err := strconv.Atoi(v)
+	if err != nil || size < tftp.MinBlockSize {
+		return nil, &tftp.Error{Code: tftp.ErrOptionRefused, Message: "invalid blksize " + v}
+	}
+	maxSize := s.tftp.MaxBlockSize
+	if maxSize <= 0 || maxSize > tftp.MaxBlockSize {
+		maxSize = tftp.MaxBlockSize
+	}
+	tc.BlockSize = min(size, maxSize)
+	// options the server does not know are left out, which declines them
+	return tftp.AppendOACK(nil, map[string]string{tftp.OptBlockSize: strconv.Itoa(tc.BlockSize)}), nil
+}
+
+func (s *UDPServer) serveRead(tc *tftp.Conn, req tftp.Packet) (int64, error) {
+	oack, terr := s.negotiate(tc, req)
+	if terr != nil {
+		tc.Abort(terr)
+		return 0, terr
+	}
+	path, terr := s.resolveTFTPPath(req.Filename, false)
+	if terr != nil {
+		tc.Abort(terr)
+		return 0, terr
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		terr := fileError(err)
+		tc.Abort(terr)
+		return 0, terr
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err != nil || !fi.Mode().IsRegular() {
+		terr := &tftp.Error{Code: tftp.ErrAccess, Message: "not a regular file"}
+		tc.Abort(terr)
+		return 0, terr
+	}
+
+	var r io.Reader = f
+	if req.Mode == tftp.ModeNetASCII {
+		r = tftp.NewNetASCIIReader(f)
+	}
+	return tc.Send(s.transferCtx, r, oack, nil)
+}
+
+func (s *UDPServer) serveWrite(tc *tftp.Conn, req tftp.Packet) (int64, error) {
+	oack, terr := s.negotiate(tc, req)
+	if terr != nil {
+		tc.Abort(terr)
+		return 0, terr
+	}
+	if !s.tftp.Writable {
+		terr := &tftp.Error{Code: tftp.ErrAccess, Message: "writes are disabled"}
+		tc.Abort(terr)
+		return 0, terr
+	}
+	path, terr := s.resolveTFTPPath(req.Filename, true)
+	if terr != nil {
+		tc.Abort(terr)
+		return 0, terr
+	}
+	exists := &tftp.Error{Code: tftp.ErrFileExists, Message: "file already exists"}
+	// refuse early when we can; the link below is what keeps an upload that lost a
+	// race from overwriting the winner
+	if _, err := os.Lstat(path); err == nil {
+		tc.Abort(exists)
+		return 0, exists
+	}
+
+	// the upload only takes the file's name once it is complete
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".part-*")
+	if err != nil {
+		terr := fileError(err)
+		tc.Abort(terr)
+		return 0, terr
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	var w io.Writer = tmp
+	var ascii *tftp.NetASCIIWriter
+	if req.Mode == tftp.ModeNetASCII {
+		ascii = tftp.NewNetASCIIWriter(tmp)
+		w = ascii
+	}
+	if oack == nil {
+		oack = tftp.AppendAck(nil, 0)
+	}
+	n, err := tc.Receive(s.transferCtx, w, oack, nil)
+	if err != nil {
+		return n, err
+	}
+	if ascii != nil {
+		err = ascii.Flush()
+	}
+	if err == nil {
+		err = tmp.Close()
+	}
+	if err == nil {
+		err = os.Link(tmp.Name(), path)
+	}
+	if errors.Is(err, fs.ErrExist) {
+		// the client may still hear this while it waits out a lost final ACK
+		tc.Abort(exists)
+		return n, exists
+	}
+	tc.Dally()
+	return n, err
+}
+
+// resolveTFTPPath maps a requested file name to a path under the root, refusing names
+// that lead outside it. For a write, the file itself need not exist yet.
+func (s *UDPServer) resolveTFTPPath(name string, write bool) (string, *tftp.Error) {
+	outside := &tftp.Error{Code: tftp.ErrAccess, Message: "path outside the served directory"}
+
+	root, err := filepath.EvalSymlinks(s.tftp.Root)
+	if err != nil {
+		return "", &tftp.Error{Code: tftp.ErrUndefined, Message: "served directory unavailable"}
+	}
+	// clients commonly ask for "/file" meaning the file at the root
+	rel := filepath.FromSlash(strings.TrimLeft(name, "/"))
+	if !filepath.IsLocal(rel) {
+		return "", outside
+	}
+	path := filepath.Join(root, rel)
+
+	// follow symbolic links, which may point anywhere
+	dir := path
+	if write {
+		dir = filepath.Dir(path)
+	}
+	real, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", fileError(err)
+	}
+	if inside, err := filepath.Rel(root, real); err != nil || !filepath.IsLocal(inside) {
+		return "", outside
+	}
+	if write {
+		return filepath.Join(real, filepath.Base(path)), nil
+	}
+	return real, nil
+}
+
+func fileError(err error) *tftp.Error {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return &tftp.Error{Code: tftp.ErrNotFound, Message: "file not found"}
+	case errors.Is(err, fs.ErrPermission):
+		return &tftp.Error{Code: tftp.ErrAccess, Message: "permission denied"}
+	default:
+		return &tftp.Error{Code: tftp.ErrUndefined, Message: err.Error()}
+	}
+}
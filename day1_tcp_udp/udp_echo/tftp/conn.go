@@ -0,0 +1,262 @@
+package tftp
+
+import (
+	"cmp"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	DefaultBlockSize = 512
+	// MinBlockSize and MaxBlockSize bound the blksize option (RFC 2348).
+	MinBlockSize = 8
+	MaxBlockSize = 65464
+
+	DefaultTimeout = time.Second
+	DefaultRetries = 5
+)
+
+// ErrTimeout is returned when the peer stops answering.
+var ErrTimeout = errors.New("tftp peer stopped answering")
+
+// Conn is one end of a transfer. Its socket is its own: the socket's port is this
+// end's transfer ID, and packets from anywhere but the peer's are turned away.
+type Conn struct {
+	pc   net.PacketConn
+	peer net.Addr // nil until the server's first reply reaches a client
+	to   net.Addr // where packets go while peer is unknown
+
+	// BlockSize is DefaultBlockSize until option negotiation agrees on another.
+	BlockSize int
+	// Timeout is how long to wait for an answer before retransmitting; Retries is
+	// how many retransmissions go unanswered before the transfer is abandoned.
+	Timeout time.Duration
+	Retries int
+
+	retransmits int
+	buf         []byte
+	final       []byte // the ACK that ended a Receive
+}
+
+// NewServerConn returns the server end of a transfer with the client at peer.
+func NewServerConn(pc net.PacketConn, peer net.Addr) *Conn {
+	return &Conn{pc: pc, peer: peer, to: peer, BlockSize: DefaultBlockSize}
+}
+
+// NewClientConn returns the client end of a transfer requested from the server at
+// addr. The server answers from a port of its own, which becomes the peer's transfer ID.
+func NewClientConn(pc net.PacketConn, addr net.Addr) *Conn {
+	return &Conn{pc: pc, to: addr, BlockSize: DefaultBlockSize}
+}
+
+// Retransmits counts the packets this end has sent again after a timeout.
+func (c *Conn) Retransmits() int {
+	return c.retransmits
+}
+
+func (c *Conn) Close() error {
+	return c.pc.Close()
+}
+
+// Abort tells the peer why the transfer is ending. Nobody acknowledges an ERROR, so it
+// is sent once and may be lost.
+func (c *Conn) Abort(e *Error) {
+	c.pc.WriteTo(AppendError(nil, e), cmp.Or(c.peer, c.to))
+}
+
+// Send sends r to the peer as DATA blocks, each acknowledged before the next goes out,
+// and returns the number of bytes acknowledged. out, unless nil, must be acknowledged
+// first with ACK 0: it is the OACK answering a RRQ, or a WRQ. A client that asked for
+// options passes negotiate, which is given the options of an OACK standing in for that
+// ACK 0 and refuses them by returning an error. Cancelling ctx closes the Conn.
+func (c *Conn) Send(ctx context.Context, r io.Reader, out []byte, negotiate func(map[string]string) error) (int64, error) {
+	stop := context.AfterFunc(ctx, func() { c.pc.Close() })
+	defer stop()
+
+	if out != nil {
+		p, err := c.exchange(ctx, out, func(p Packet) bool {
+			return (p.Op == OpACK && p.Block == 0) || (p.Op == OpOACK && negotiate != nil)
+		})
+		if err != nil {
+			return 0, err
+		}
+		if p.Op == OpOACK {
+			if err := negotiate(p.Options); err != nil {
+				c.Abort(&Error{Code: ErrOptionRefused, Message: err.Error()})
+				return 0, err
+			}
+		}
+	}
+
+	buf := make([]byte, c.BlockSize)
+	var total int64
+	// block numbers wrap around to 0 after 65535, which lets files of any size through
+	for block := uint16(1); ; block++ {
+		n, err := io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			c.Abort(&Error{Code: ErrUndefined, Message: err.Error()})
+			return total, err
+		}
+		// a duplicate ACK for the previous block is ignored rather than answered, or
+		// every block after a delayed ACK would be sent twice (the Sorcerer's
+		// Apprentice syndrome)
+		_, err = c.exchange(ctx, AppendData(nil, block, buf[:n]), func(p Packet) bool {
+			return p.Op == OpACK && p.Block == block
+		})
+		if err != nil {
+			return total, err
+		}
+		total += int64(n)
+		if n < c.BlockSize {
+			return total, nil
+		}
+	}
+}
+
+// Receive writes the DATA blocks the peer sends to w, acknowledging each, until a block
+// shorter than BlockSize ends the transfer, and returns the number of bytes written.
+// out is the packet that asks for the first block: a RRQ, or the ACK 0 or OACK
+// answering a WRQ. negotiate is as for Send, for the OACK that may answer a RRQ.
+// Cancelling ctx closes the Conn. Call Dally once the data is taken care of.
+func (c *Conn) Receive(ctx context.Context, w io.Writer, out []byte, negotiate func(map[string]string) error) (int64, error) {
+	stop := context.AfterFunc(ctx, func() { c.pc.Close() })
+	defer stop()
+
+	var total int64
+	block := uint16(1)
+	for {
+		p, err := c.exchange(ctx, out, func(p Packet) bool {
+			return (p.Op == OpDATA && p.Block == block) || (p.Op == OpOACK && negotiate != nil)
+		})
+		if err != nil {
+			return total, err
+		}
+		if p.Op == OpOACK {
+			if err := negotiate(p.Options); err != nil {
+				c.Abort(&Error{Code: ErrOptionRefused, Message: err.Error()})
+				return total, err
+			}
+			negotiate = nil
+			out = AppendAck(nil, 0)
+			continue
+		}
+		// a DATA block without an OACK means the server ignored the options
+		negotiate = nil
+
+		if _, err := w.Write(p.Data); err != nil {
+			c.Abort(&Error{Code: ErrUndefined, Message: err.Error()})
+			return total, err
+		}
+		total += int64(len(p.Data))
+		out = AppendAck(nil, block)
+		if len(p.Data) < c.BlockSize {
+			c.pc.WriteTo(out, c.peer)
+			c.final = out
+			return total, nil
+		}
+		block++
+	}
+}
+
+// exchange sends out and waits for a packet from the peer that accept takes,
+// retransmitting out each time Timeout passes without one. An ERROR from the peer ends
+// the exchange with that error.
+func (c *Conn) exchange(ctx context.Context, out []byte, accept func(Packet) bool) (Packet, error) {
+	timeout := cmp.Or(c.Timeout, DefaultTimeout)
+	retries := cmp.Or(c.Retries, DefaultRetries)
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			c.retransmits++
+		}
+		if _, err := c.pc.WriteTo(out, cmp.Or(c.peer, c.to)); err != nil {
+			return Packet{}, cmp.Or(ctx.Err(), err)
+		}
+
+		deadline := time.Now().Add(timeout)
+		for {
+			p, err := c.read(deadline)
+			if isTimeout(err) {
+				break
+			} else if err != nil {
+				return Packet{}, cmp.Or(ctx.Err(), err)
+			}
+			if p.Op == OpERROR {
+				return Packet{}, p.Err
+			}
+			if accept(p) {
+				return p, nil
+			}
+		}
+	}
+	return Packet{}, fmt.Errorf("%w after %d attempts", ErrTimeout, retries+1)
+}
+
+// Dally waits out one Timeout after Receive, acknowledging the final block again should
+// the peer resend it because the last ACK was lost, so the peer does not give up on a
+// transfer that succeeded.
+func (c *Conn) Dally() {
+	if c.final == nil {
+		return
+	}
+	block := binary.BigEndian.Uint16(c.final[2:])
+	deadline := time.Now().Add(cmp.Or(c.Timeout, DefaultTimeout))
+	for {
+		p, err := c.read(deadline)
+		if err != nil {
+			return
+		}
+		if p.Op == OpDATA && p.Block == block {
+			c.pc.WriteTo(c.final, c.peer)
+		}
+	}
+}
+
+// read returns the next well-formed packet from the peer, turning away anyone else.
+func (c *Conn) read(deadline time.Time) (Packet, error) {
+	if c.buf == nil {
+		c.buf = make([]byte, MaxBlockSize+4)
+	}
+	c.pc.SetReadDeadline(deadline)
+	for {
+		n, from, err := c.pc.ReadFrom(c.buf)
+		if err != nil {
+			return Packet{}, err
+		}
+		p, err := Parse(c.buf[:n])
+		if !c.fromPeer(from) {
+			if err == nil && p.Op != OpERROR {
+				c.pc.WriteTo(AppendError(nil, &Error{Code: ErrUnknownTID, Message: "unknown transfer ID"}), from)
+			}
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		return p, nil
+	}
+}
+
+// fromPeer reports whether a packet from addr belongs to this transfer. A client takes
+// the first answer from the server's host as coming from the server's transfer ID.
+func (c *Conn) fromPeer(addr net.Addr) bool {
+	if c.peer != nil {
+		return addr.String() == c.peer.String()
+	}
+	from, ok1 := addr.(*net.UDPAddr)
+	to, ok2 := c.to.(*net.UDPAddr)
+	if !ok1 || !ok2 || !from.IP.Equal(to.IP) {
+		return false
+	}
+	c.peer = addr
+	return true
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
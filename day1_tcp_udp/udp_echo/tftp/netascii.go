@@ -0,0 +1,98 @@
+package tftp
+
+import (
+	"bufio"
+	"io"
+)
+
+// netASCIIReader translates local text to netascii: LF becomes CR LF and a lone CR
+// becomes CR NUL.
+type netASCIIReader struct {
+	r       *bufio.Reader
+	pending int // byte owed after a CR, or -1
+}
+
+// NewNetASCIIReader returns a reader of r translated to netascii for sending.
+func NewNetASCIIReader(r io.Reader) io.Reader {
+	return &netASCIIReader{r: bufio.NewReader(r), pending: -1}
+}
+
+func (a *netASCIIReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if a.pending >= 0 {
+			p[n] = byte(a.pending)
+			a.pending = -1
+			n++
+			continue
+		}
+		b, err := a.r.ReadByte()
+		if err != nil {
+			if n > 0 {
+				return n, nil
+			}
+			return 0, err
+		}
+		switch b {
+		case '\n':
+			p[n], a.pending = '\r', '\n'
+		case '\r':
+			p[n], a.pending = '\r', 0
+		default:
+			p[n] = b
+		}
+		n++
+	}
+	return n, nil
+}
+
+// NetASCIIWriter translates received netascii back to local text, undoing what
+// NewNetASCIIReader does. A CR followed by anything else is kept as it is.
+type NetASCIIWriter struct {
+	w   io.Writer
+	cr  bool
+	out []byte
+}
+
+func NewNetASCIIWriter(w io.Writer) *NetASCIIWriter {
+	return &NetASCIIWriter{w: w}
+}
+
+func (a *NetASCIIWriter) Write(p []byte) (int, error) {
+	out := a.out[:0]
+	for _, b := range p {
+		if a.cr {
+			a.cr = false
+			switch b {
+			case '\n':
+				out = append(out, '\n')
+				continue
+			case 0:
+				out = append(out, '\r')
+				continue
+			default:
+				out = append(out, '\r')
+			}
+		}
+		if b == '\r' {
+			a.cr = true
+			continue
+		}
+		out = append(out, b)
+	}
+	a.out = out
+	if _, err := a.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush writes a CR left hanging at the end of the transfer.
+func (a *NetASCIIWriter) Flush() error {
+	if !a.cr {
+		return nil
+	}
+	a.cr = false
+	_, err := a.w.Write([]byte{'\r'})
+	return err
+}
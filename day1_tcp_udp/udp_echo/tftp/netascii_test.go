@@ -0,0 +1,36 @@
+package tftp_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/pixperk/bloodsport/day1_tcp_udp/udp_echo/tftp"
+)
+
+func TestNetASCIIRoundTrip(t *testing.T) {
+	const text = "one\ntwo\r\nlone\rcr\r"
+
+	wire, err := io.ReadAll(tftp.NewNetASCIIReader(bytes.NewReader([]byte(text))))
+	if err != nil {
+		t.Fatalf("Reading netascii failed: %v", err)
+	}
+	if want := "one\r\ntwo\r\x00\r\nlone\r\x00cr\r\x00"; string(wire) != want {
+		t.Errorf("Expected %q on the wire, got %q", want, wire)
+	}
+
+	var local bytes.Buffer
+	w := tftp.NewNetASCIIWriter(&local)
+	// split between a CR and what follows it
+	for _, chunk := range [][]byte{wire[:4], wire[4:]} {
+		if _, err := w.Write(chunk); err != nil {
+			t.Fatalf("Writing netascii failed: %v", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if local.String() != text {
+		t.Errorf("Expected %q back, got %q", text, local.String())
+	}
+}
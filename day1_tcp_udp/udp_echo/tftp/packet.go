@@ -0,0 +1,181 @@
+// Package tftp implements the Trivial File Transfer Protocol of RFC 1350, with option
+// negotiation (RFC 2347) for the block size option of RFC 2348. It provides the packet
+// encoding and the lock-step DATA/ACK exchange shared by the UDP echo server's TFTP
+// mode and the client's TFTPClient.
+package tftp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+type Opcode uint16
+
+const (
+	OpRRQ   Opcode = 1
+	OpWRQ   Opcode = 2
+	OpDATA  Opcode = 3
+	OpACK   Opcode = 4
+	OpERROR Opcode = 5
+	// OpOACK acknowledges the options of a request (RFC 2347).
+	OpOACK Opcode = 6
+)
+
+type ErrorCode uint16
+
+const (
+	ErrUndefined     ErrorCode = 0
+	ErrNotFound      ErrorCode = 1
+	ErrAccess        ErrorCode = 2
+	ErrDiskFull      ErrorCode = 3
+	ErrIllegalOp     ErrorCode = 4
+	ErrUnknownTID    ErrorCode = 5
+	ErrFileExists    ErrorCode = 6
+	ErrNoSuchUser    ErrorCode = 7
+	ErrOptionRefused ErrorCode = 8
+)
+
+// Error is an ERROR packet, sent or received. A transfer that ends with one returns it.
+type Error struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("tftp error %d: %s", e.Code, e.Message)
+}
+
+// Modes a request may ask for. Mail mode is obsolete and not supported.
+const (
+	ModeOctet    = "octet"
+	ModeNetASCII = "netascii"
+)
+
+// OptBlockSize names the block size option of RFC 2348.
+const OptBlockSize = "blksize"
+
+// Packet is any TFTP packet; which fields are set depends on Op.
+type Packet struct {
+	Op Opcode
+
+	// RRQ and WRQ
+	Filename string
+	Mode     string
+	// RRQ, WRQ and OACK; option names are lower case
+	Options map[string]string
+
+	// DATA and ACK
+	Block uint16
+	// DATA
+	Data []byte
+
+	// ERROR
+	Err *Error
+}
+
+var errMalformed = errors.New("malformed tftp packet")
+
+// Parse decodes b. DATA payloads alias b.
+func Parse(b []byte) (Packet, error) {
+	if len(b) < 2 {
+		return Packet{}, errMalformed
+	}
+	p := Packet{Op: Opcode(binary.BigEndian.Uint16(b))}
+	body := b[2:]
+	switch p.Op {
+	case OpRRQ, OpWRQ:
+		fields, ok := strings0(body)
+		if !ok || len(fields) < 2 || len(fields)%2 != 0 || fields[0] == "" {
+			return Packet{}, errMalformed
+		}
+		p.Filename, p.Mode = fields[0], strings.ToLower(fields[1])
+		p.Options = options(fields[2:])
+	case OpOACK:
+		fields, ok := strings0(body)
+		if !ok || len(fields)%2 != 0 {
+			return Packet{}, errMalformed
+		}
+		p.Options = options(fields)
+	case OpDATA, OpACK:
+		if len(body) < 2 || (p.Op == OpACK && len(body) != 2) {
+			return Packet{}, errMalformed
+		}
+		p.Block = binary.BigEndian.Uint16(body)
+		if p.Op == OpDATA {
+			p.Data = body[2:]
+		}
+	case OpERROR:
+		if len(body) < 2 {
+			return Packet{}, errMalformed
+		}
+		// some implementations leave off the terminating NUL
+		msg, _, _ := bytes.Cut(body[2:], []byte{0})
+		p.Err = &Error{Code: ErrorCode(binary.BigEndian.Uint16(body)), Message: string(msg)}
+	default:
+		return Packet{}, errMalformed
+	}
+	return p, nil
+}
+
+// strings0 splits a run of NUL-terminated strings.
+func strings0(b []byte) ([]string, bool) {
+	if len(b) == 0 || b[len(b)-1] != 0 {
+		return nil, false
+	}
+	return strings.Split(string(b[:len(b)-1]), "\x00"), true
+}
+
+func options(fields []string) map[string]string {
+	opts := make(map[string]string, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		opts[strings.ToLower(fields[i])] = fields[i+1]
+	}
+	return opts
+}
+
+// AppendRequest appends a RRQ or WRQ for filename in mode, with opts if any.
+func AppendRequest(dst []byte, op Opcode, filename, mode string, opts map[string]string) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, uint16(op))
+	dst = append(append(dst, filename...), 0)
+	dst = append(append(dst, mode...), 0)
+	return appendOptions(dst, opts)
+}
+
+func AppendOACK(dst []byte, opts map[string]string) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, uint16(OpOACK))
+	return appendOptions(dst, opts)
+}
+
+func appendOptions(dst []byte, opts map[string]string) []byte {
+	names := make([]string, 0, len(opts))
+	for name := range opts {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		dst = append(append(dst, name...), 0)
+		dst = append(append(dst, opts[name]...), 0)
+	}
+	return dst
+}
+
+func AppendData(dst []byte, block uint16, data []byte) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, uint16(OpDATA))
+	dst = binary.BigEndian.AppendUint16(dst, block)
+	return append(dst, data...)
+}
+
+func AppendAck(dst []byte, block uint16) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, uint16(OpACK))
+	return binary.BigEndian.AppendUint16(dst, block)
+}
+
+func AppendError(dst []byte, e *Error) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, uint16(OpERROR))
+	dst = binary.BigEndian.AppendUint16(dst, uint16(e.Code))
+	return append(append(dst, e.Message...), 0)
+}
@@ -0,0 +1,70 @@
+package tftp_test
+
+import (
+	"maps"
+	"testing"
+
+	"github.com/pixperk/bloodsport/day1_tcp_udp/udp_echo/tftp"
+)
+
+func TestPacketRoundTrip(t *testing.T) {
+	opts := map[string]string{tftp.OptBlockSize: "1024", "tsize": "0"}
+
+	req, err := tftp.Parse(tftp.AppendRequest(nil, tftp.OpWRQ, "dir/file", "NetASCII", opts))
+	if err != nil {
+		t.Fatalf("Parse WRQ failed: %v", err)
+	}
+	if req.Op != tftp.OpWRQ || req.Filename != "dir/file" || req.Mode != tftp.ModeNetASCII || !maps.Equal(req.Options, opts) {
+		t.Errorf("Expected the WRQ back with its mode lower-cased, got %+v", req)
+	}
+
+	oack, err := tftp.Parse(tftp.AppendOACK(nil, opts))
+	if err != nil || oack.Op != tftp.OpOACK || !maps.Equal(oack.Options, opts) {
+		t.Errorf("Expected the OACK back, got %+v (%v)", oack, err)
+	}
+
+	data, err := tftp.Parse(tftp.AppendData(nil, 7, []byte("block")))
+	if err != nil || data.Op != tftp.OpDATA || data.Block != 7 || string(data.Data) != "block" {
+		t.Errorf("Expected DATA 7 back, got %+v (%v)", data, err)
+	}
+	empty, err := tftp.Parse(tftp.AppendData(nil, 8, nil))
+	if err != nil || empty.Block != 8 || len(empty.Data) != 0 {
+		t.Errorf("Expected an empty DATA 8 back, got %+v (%v)", empty, err)
+	}
+
+	ack, err := tftp.Parse(tftp.AppendAck(nil, 65535))
+	if err != nil || ack.Op != tftp.OpACK || ack.Block != 65535 {
+		t.Errorf("Expected ACK 65535 back, got %+v (%v)", ack, err)
+	}
+
+	sent := &tftp.Error{Code: tftp.ErrFileExists, Message: "already there"}
+	e, err := tftp.Parse(tftp.AppendError(nil, sent))
+	if err != nil || e.Op != tftp.OpERROR || *e.Err != *sent {
+		t.Errorf("Expected the ERROR back, got %+v (%v)", e, err)
+	}
+	// some implementations leave off the terminating NUL
+	e, err = tftp.Parse([]byte("\x00\x05\x00\x01no such file"))
+	if err != nil || e.Err.Code != tftp.ErrNotFound || e.Err.Message != "no such file" {
+		t.Errorf("Expected an unterminated ERROR accepted, got %+v (%v)", e, err)
+	}
+}
+
+func TestParseRejectsMalformed(t *testing.T) {
+	for name, b := range map[string][]byte{
+		"empty":            nil,
+		"short opcode":     {0},
+		"unknown opcode":   {0, 9},
+		"unterminated RRQ": []byte("\x00\x01file\x00octet"),
+		"RRQ without mode": []byte("\x00\x01file\x00"),
+		"empty filename":   []byte("\x00\x01\x00octet\x00"),
+		"odd options":      []byte("\x00\x01file\x00octet\x00blksize\x00"),
+		"odd OACK":         []byte("\x00\x06blksize\x00"),
+		"short DATA":       {0, 3, 0},
+		"long ACK":         {0, 4, 0, 1, 0},
+		"short ERROR":      {0, 5, 0},
+	} {
+		if p, err := tftp.Parse(b); err == nil {
+			t.Errorf("%s: Expected an error, got %+v", name, p)
+		}
+	}
+}
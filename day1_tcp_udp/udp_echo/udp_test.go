@@ -1,29 +1,53 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
 	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/pixperk/bloodsport/day1_tcp_udp/discovery"
+	"github.com/pixperk/bloodsport/day1_tcp_udp/netem"
 	"github.com/pixperk/bloodsport/day1_tcp_udp/udp_echo/client"
 	"github.com/pixperk/bloodsport/day1_tcp_udp/udp_echo/server"
+	"github.com/pixperk/bloodsport/day1_tcp_udp/udp_echo/tftp"
+	"github.com/pixperk/bloodsport/day1_tcp_udp/udp_echo/wire"
 )
 
-func TestUDPBasicEchoWithoutPacketLoss(t *testing.T) {
+// startUDPServer serves on a kernel-assigned port and closes the server with the test.
+func startUDPServer(t *testing.T, opts ...server.Option) (*server.UDPServer, string) {
+	t.Helper()
 
-	srv := server.NewUDPServer("localhost:9999")
+	srv := server.NewUDPServer("127.0.0.1:0", opts...)
+	go srv.Start(context.Background())
+	t.Cleanup(func() { srv.Close() })
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	select {
+	case <-srv.Ready():
+	case <-time.After(2 * time.Second):
+		t.Fatal("server did not start listening")
+	}
+	return srv, srv.Addr().String()
+}
 
-	go srv.Start(ctx)
-	time.Sleep(200 * time.Millisecond) // Give more time to start
+func TestUDPBasicEchoWithoutPacketLoss(t *testing.T) {
+	_, addr := startUDPServer(t)
 
-	cli, err := client.NewUDPClient("localhost:9999", 3*time.Second)
+	cli, err := client.NewUDPClient(addr, 3*time.Second)
 	if err != nil {
 		t.Fatalf("Failed to create client: %v", err)
 	}
+	defer cli.Close()
 
 	// Test single message
 	testMsg := "Hello UDP Server"
@@ -46,16 +70,9 @@ func TestUDPBasicEchoWithoutPacketLoss(t *testing.T) {
 }
 
 func TestUDPManualConnection(t *testing.T) {
+	_, addr := startUDPServer(t)
 
-	srv := server.NewUDPServer("127.0.0.1:9997")
-
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	go srv.Start(ctx)
-	time.Sleep(200 * time.Millisecond)
-
-	conn, err := net.Dial("udp", "127.0.0.1:9997")
+	conn, err := net.Dial("udp", addr)
 	if err != nil {
 		t.Fatalf("Failed to dial UDP: %v", err)
 	}
@@ -83,3 +100,852 @@ func TestUDPManualConnection(t *testing.T) {
 		t.Logf("Manual UDP test passed: %q", response)
 	}
 }
+
+func TestUDPConcurrentPacketsKeepTheirData(t *testing.T) {
+	srv, addr := startUDPServer(t, server.WithWorkers(4))
+
+	const clients, messages = 8, 50
+	var wg sync.WaitGroup
+	for i := range clients {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn, err := net.Dial("udp", addr)
+			if err != nil {
+				t.Errorf("Failed to dial UDP: %v", err)
+				return
+			}
+			defer conn.Close()
+
+			buffer := make([]byte, 1024)
+			for j := range messages {
+				message := fmt.Sprintf("client %d message %d", i, j)
+				if _, err := conn.Write([]byte(message)); err != nil {
+					t.Errorf("Failed to send: %v", err)
+					return
+				}
+				conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+				n, err := conn.Read(buffer)
+				if err != nil {
+					t.Errorf("Failed to read: %v", err)
+					return
+				}
+				if expected := "ECHO : " + message; string(buffer[:n]) != expected {
+					t.Errorf("Expected %q, got %q", expected, buffer[:n])
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if got := srv.Stats().Received; got != clients*messages {
+		t.Errorf("Expected %d packets received, got %d", clients*messages, got)
+	}
+}
+
+func TestUDPMaxDatagramSize(t *testing.T) {
+	srv, addr := startUDPServer(t, server.WithMaxDatagramSize(2000))
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial UDP: %v", err)
+	}
+	defer conn.Close()
+
+	buffer := make([]byte, 4096)
+	for _, size := range []int{1500, 3000} {
+		if _, err := conn.Write(bytes.Repeat([]byte("x"), size)); err != nil {
+			t.Fatalf("Failed to send: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		n, err := conn.Read(buffer)
+		if err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+		if expected := len("ECHO : ") + min(size, 2000); n != expected {
+			t.Errorf("Expected a %d byte echo of a %d byte datagram, got %d", expected, size, n)
+		}
+	}
+
+	if got := srv.Stats().Truncated; got != 1 {
+		t.Errorf("Expected 1 truncated datagram, got %d", got)
+	}
+}
+
+func TestUDPServerImpairedReplies(t *testing.T) {
+	_, addr := startUDPServer(t, server.WithImpairment(netem.Config{Latency: 100 * time.Millisecond}))
+
+	cli, err := client.NewUDPClient(addr, 3*time.Second)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	start := time.Now()
+	if err := cli.SendMessage("slow"); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	response, err := cli.ReceiveMessage()
+	if err != nil {
+		t.Fatalf("Failed to receive message: %v", err)
+	}
+	if response != "ECHO : slow" {
+		t.Errorf("Expected %q, got %q", "ECHO : slow", response)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("Expected the reply to be delayed by 100ms, took %v", elapsed)
+	}
+}
+
+func TestUDPReliableDeliveryUnderLoss(t *testing.T) {
+	// requests are dropped on the way in and ACKs on the way out
+	srv, addr := startUDPServer(t, server.WithImpairment(netem.Config{Seed: 3, Loss: 0.15}))
+	srv.SetPacketLoss(0.15)
+
+	cli, err := client.NewUDPClient(addr, 3*time.Second)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	retransmitted := 0
+	for i := range 30 {
+		msg := fmt.Sprintf("reliable %d", i)
+		d, err := cli.SendReliable(context.Background(), msg)
+		if err != nil {
+			t.Fatalf("Message %d was not delivered: %v", i, err)
+		}
+		if d.Reply != "ECHO : "+msg {
+			t.Errorf("Expected %q, got %q", "ECHO : "+msg, d.Reply)
+		}
+		if d.Attempts > 1 {
+			retransmitted++
+		}
+	}
+	if retransmitted == 0 {
+		t.Error("Expected some messages to need retransmission")
+	}
+	if srv.Stats().Duplicates == 0 {
+		t.Error("Expected the server to suppress retransmissions whose ACK was lost")
+	}
+	if rto := cli.RTO(); rto >= time.Second {
+		t.Errorf("Expected the RTO to adapt to loopback round trips, got %v", rto)
+	}
+}
+
+func TestUDPReliableDuplicateSuppression(t *testing.T) {
+	srv, addr := startUDPServer(t)
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial UDP: %v", err)
+	}
+	defer conn.Close()
+
+	datagram := wire.Append(nil, wire.Header{Kind: wire.KindData, Seq: 5}, []byte("once"))
+	buffer := make([]byte, 1024)
+	for range 2 {
+		if _, err := conn.Write(datagram); err != nil {
+			t.Fatalf("Failed to send: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		n, err := conn.Read(buffer)
+		if err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+		h, payload, ok := wire.Parse(buffer[:n])
+		if !ok || h.Kind != wire.KindAck || h.Seq != 5 || string(payload) != "ECHO : once" {
+			t.Errorf("Expected ACK 5 carrying the echo, got %+v %q", h, payload)
+		}
+	}
+	if got := srv.Stats().Duplicates; got != 1 {
+		t.Errorf("Expected 1 duplicate, got %d", got)
+	}
+}
+
+func TestUDPReliableCacheBound(t *testing.T) {
+	srv, addr := startUDPServer(t, server.WithMaxDatagramSize(64*1024))
+
+	payload := bytes.Repeat([]byte{'r'}, 60000)
+	buffer := make([]byte, 64*1024)
+	send := func(conn net.Conn, seq uint32) {
+		t.Helper()
+		if _, err := conn.Write(wire.Append(nil, wire.Header{Kind: wire.KindData, Seq: seq}, payload)); err != nil {
+			t.Fatalf("Failed to send: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		n, err := conn.Read(buffer)
+		if err != nil {
+			t.Fatalf("Failed to read ACK %d: %v", seq, err)
+		}
+		if h, _, ok := wire.Parse(buffer[:n]); !ok || h != (wire.Header{Kind: wire.KindAck, Seq: seq}) {
+			t.Fatalf("Expected ACK %d, got %+v", seq, h)
+		}
+	}
+	dial := func() net.Conn {
+		conn, err := net.Dial("udp", addr)
+		if err != nil {
+			t.Fatalf("Failed to dial UDP: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+
+	// 300 cached replies of about 60KB overflow the 16MB shared by every peer, which
+	// the quiet peer pays for with its oldest replies
+	quiet, busy := dial(), dial()
+	for seq := range uint32(200) {
+		send(quiet, seq)
+	}
+	for seq := range uint32(100) {
+		send(busy, seq)
+	}
+
+	send(quiet, 0)
+	if got := srv.Stats().Duplicates; got != 0 {
+		t.Errorf("Expected the quiet peer's oldest reply evicted, got %d duplicates", got)
+	}
+	send(quiet, 199)
+	send(busy, 99)
+	if got := srv.Stats().Duplicates; got != 2 {
+		t.Errorf("Expected recent replies to stay cached, got %d duplicates", got)
+	}
+}
+
+func TestUDPUnknownKindEchoedPlain(t *testing.T) {
+	_, addr := startUDPServer(t)
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial UDP: %v", err)
+	}
+	defer conn.Close()
+
+	datagram := append([]byte{wire.Magic, 0x7f, 0, 0, 0, 1}, "not framed"...)
+	if _, err := conn.Write(datagram); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	buffer := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	n, err := conn.Read(buffer)
+	if err != nil {
+		t.Fatalf("Expected an echo of a datagram of unknown kind: %v", err)
+	}
+	if want := append([]byte("ECHO : "), datagram...); !bytes.Equal(buffer[:n], want) {
+		t.Errorf("Expected %q, got %q", want, buffer[:n])
+	}
+}
+
+func TestUDPFragmentDroppedWithoutFragmentation(t *testing.T) {
+	_, addr := startUDPServer(t)
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial UDP: %v", err)
+	}
+	defer conn.Close()
+
+	frags, err := wire.Split([]byte("a message split into fragments"), 1, 16)
+	if err != nil {
+		t.Fatalf("Split failed: %v", err)
+	}
+	for _, f := range frags {
+		if _, err := conn.Write(f); err != nil {
+			t.Fatalf("Failed to send: %v", err)
+		}
+	}
+	// the first reply must be the plain message's, as the fragments get none
+	if _, err := conn.Write([]byte("plain")); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	buffer := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	n, err := conn.Read(buffer)
+	if err != nil {
+		t.Fatalf("Expected an echo of the plain message: %v", err)
+	}
+	if got := string(buffer[:n]); got != "ECHO : plain" {
+		t.Errorf("Expected only the plain message answered, got %q", got)
+	}
+}
+
+func TestUDPConcurrentDo(t *testing.T) {
+	// duplicated and reordered responses must still reach the right caller
+	_, addr := startUDPServer(t, server.WithImpairment(netem.Config{Seed: 11, Duplicate: 0.3, Reorder: 0.3}))
+
+	cli, err := client.NewUDPClient(addr, 3*time.Second)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer cli.Close()
+
+	var wg sync.WaitGroup
+	for i := range 10 {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := range 20 {
+				msg := fmt.Sprintf("caller %d request %d", i, j)
+				reply, err := cli.Do(context.Background(), []byte(msg))
+				if err != nil {
+					t.Errorf("Request failed: %v", err)
+					return
+				}
+				if expected := "ECHO : " + msg; string(reply) != expected {
+					t.Errorf("Expected %q, got %q", expected, reply)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// duplicates of the last responses may still be on their way
+	time.Sleep(50 * time.Millisecond)
+	if cli.LateReplies() == 0 {
+		t.Error("Expected duplicated responses to be discarded as late")
+	}
+}
+
+func TestUDPDoDiscardsLateReply(t *testing.T) {
+	_, addr := startUDPServer(t, server.WithImpairment(netem.Config{Latency: 150 * time.Millisecond}))
+
+	cli, err := client.NewUDPClient(addr, 3*time.Second)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer cli.Close()
+
+	callCtx, callCancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer callCancel()
+	if _, err := cli.Do(callCtx, []byte("too slow")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected the call to time out, got %v", err)
+	}
+
+	reply, err := cli.Do(context.Background(), []byte("patient"))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if string(reply) != "ECHO : patient" {
+		t.Errorf("Expected %q, got %q", "ECHO : patient", reply)
+	}
+	if got := cli.LateReplies(); got != 1 {
+		t.Errorf("Expected 1 late reply, got %d", got)
+	}
+}
+
+func TestUDPServerLifecycle(t *testing.T) {
+	srv := server.NewUDPServer("127.0.0.1:0")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errs := make(chan error, 1)
+	go func() { errs <- srv.Start(ctx) }()
+	select {
+	case <-srv.Ready():
+	case <-time.After(2 * time.Second):
+		t.Fatal("server did not start listening")
+	}
+	if !srv.Running() {
+		t.Error("Expected the server to be running")
+	}
+	addr := srv.Addr().String()
+
+	cli, err := client.NewUDPClient(addr, 3*time.Second)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer cli.Close()
+	if reply, err := cli.Do(context.Background(), []byte("hi")); err != nil || string(reply) != "ECHO : hi" {
+		t.Fatalf("Expected %q, got %q (%v)", "ECHO : hi", reply, err)
+	}
+
+	cancel()
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Errorf("Expected Start to return nil after cancel, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Start did not return after its context was cancelled")
+	}
+	if srv.Running() {
+		t.Error("Expected the server to have stopped running")
+	}
+
+	// the socket is closed, so the port can be bound again
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Fatalf("Expected the port to be free after shutdown: %v", err)
+	}
+	pc.Close()
+
+	if err := srv.Start(context.Background()); !errors.Is(err, server.ErrServerClosed) {
+		t.Errorf("Expected ErrServerClosed restarting a closed server, got %v", err)
+	}
+	srv.Close()
+}
+
+func TestUDPDiscovery(t *testing.T) {
+	const group = "239.255.77.77:17777"
+	service := fmt.Sprintf("udp-echo-test-%d", time.Now().UnixNano())
+
+	browser, err := discovery.Browse(group)
+	if err != nil {
+		t.Skipf("multicast unavailable: %v", err)
+	}
+	defer browser.Close()
+
+	announcer := discovery.Announcer{Group: group, Interval: 50 * time.Millisecond, Service: service, Version: "test"}
+	busy, busyAddr := startUDPServer(t, server.WithAnnouncer(announcer))
+	_, idleAddr := startUDPServer(t, server.WithAnnouncer(announcer))
+
+	// give the busy server a peer, which it reports as load
+	cli, err := client.NewUDPClient(busyAddr, 3*time.Second)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer cli.Close()
+	if _, err := cli.Do(context.Background(), []byte("hi")); err != nil {
+		t.Fatalf("Do failed: %v", err)
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		live := browser.Services(service)
+		if len(live) == 2 && live[0].Addr == idleAddr && live[1].Load == 1 {
+			if live[1].Addr != busyAddr || live[0].Version != "test" || live[0].Network != "udp" {
+				t.Fatalf("Unexpected services: %+v", live)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the idle and busy servers, least loaded first, got %+v", live)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	picked, err := browser.Pick(ctx, service)
+	if err != nil || picked.Addr != idleAddr {
+		t.Errorf("Expected Pick to choose the idle server %s, got %s (%v)", idleAddr, picked.Addr, err)
+	}
+
+	// a fresh browser hears both servers within two announcement intervals and picks by load
+	found, err := client.Discover(ctx, group, service, 2*announcer.Interval, 3*time.Second)
+	if err != nil {
+		t.Fatalf("Discover failed: %v", err)
+	}
+	defer found.Close()
+	if found.SrvAddr != idleAddr {
+		t.Errorf("Expected Discover to choose the idle server %s, got %s", idleAddr, found.SrvAddr)
+	}
+	if reply, err := found.Do(ctx, []byte("found")); err != nil || string(reply) != "ECHO : found" {
+		t.Fatalf("Expected %q, got %q (%v)", "ECHO : found", reply, err)
+	}
+
+	// a server that closes withdraws itself rather than waiting to expire
+	busy.Close()
+	for {
+		live := browser.Services(service)
+		if len(live) == 1 && live[0].Addr == idleAddr {
+			break
+		}
+		if time.Now().After(deadline.Add(time.Second)) {
+			t.Fatalf("Expected only the idle server after the busy one closed, got %+v", live)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	short, cancelShort := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancelShort()
+	if _, err := discovery.Find(short, group, service+"-missing", announcer.Interval); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected Find to time out for a service nobody announces, got %v", err)
+	}
+}
+
+func TestUDPFragmentedEcho(t *testing.T) {
+	frag := wire.FragmentConfig{MTU: 512}
+	srv, addr := startUDPServer(t, server.WithFragmentation(frag))
+
+	cli, err := client.NewUDPClient(addr, 3*time.Second, client.WithFragmentation(frag))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer cli.Close()
+
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 1250) // 20000 bytes
+	reply, err := cli.Do(context.Background(), payload)
+	if err != nil {
+		t.Fatalf("Do failed: %v", err)
+	}
+	if !bytes.Equal(reply, append([]byte("ECHO : "), payload...)) {
+		t.Fatalf("Expected the %d byte payload echoed, got %d bytes", len(payload), len(reply))
+	}
+
+	d, err := cli.SendReliable(context.Background(), string(payload[:5000]))
+	if err != nil || d.Reply != "ECHO : "+string(payload[:5000]) {
+		t.Fatalf("Expected the reliable message echoed, got %d bytes (%v)", len(d.Reply), err)
+	}
+
+	if err := cli.SendMessage(string(payload[:3000])); err != nil {
+		t.Fatalf("SendMessage failed: %v", err)
+	}
+	msg, err := cli.ReceiveMessage()
+	if err != nil || msg != "ECHO : "+string(payload[:3000]) {
+		t.Fatalf("Expected the plain message echoed, got %d bytes (%v)", len(msg), err)
+	}
+
+	if got := srv.Stats().Reassembly.Reassembled; got != 3 {
+		t.Errorf("Expected the server to reassemble 3 messages, got %d", got)
+	}
+	if got := cli.Reassembly().Reassembled; got != 3 {
+		t.Errorf("Expected the client to reassemble 3 replies, got %d", got)
+	}
+
+	// every datagram on the wire fits the MTU, whichever way it goes
+	raw, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer raw.Close()
+	frags, err := wire.Split(wire.Append(nil, wire.Header{Kind: wire.KindRequest, Seq: 7}, payload), 1, frag.MTU)
+	if err != nil {
+		t.Fatalf("Split failed: %v", err)
+	}
+	// out of order, with a duplicate
+	frags = append(frags, frags[0])
+	slices.Reverse(frags)
+	for _, f := range frags {
+		if len(f) > frag.MTU {
+			t.Fatalf("Split made a %d byte fragment", len(f))
+		}
+		raw.Write(f)
+	}
+	reassembler := wire.NewReassembler(frag)
+	buf := make([]byte, 64*1024)
+	raw.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for {
+		n, err := raw.Read(buf)
+		if err != nil {
+			t.Fatalf("Failed to read fragments: %v", err)
+		}
+		if n > frag.MTU {
+			t.Fatalf("Server sent a %d byte datagram over a %d byte MTU", n, frag.MTU)
+		}
+		h, body, ok := wire.Parse(buf[:n])
+		f, isFrag := wire.ParseFragment(h, body)
+		if !ok || !isFrag {
+			t.Fatalf("Expected a fragment, got %q", buf[:n])
+		}
+		if whole, done := reassembler.Add("", f); done {
+			h, reply, _ := wire.Parse(whole)
+			if h != (wire.Header{Kind: wire.KindResponse, Seq: 7}) || !bytes.Equal(reply, append([]byte("ECHO : "), payload...)) {
+				t.Fatalf("Unexpected reassembled reply %v with %d bytes", h, len(reply))
+			}
+			break
+		}
+	}
+}
+
+func TestUDPReassemblyLimits(t *testing.T) {
+	srv, addr := startUDPServer(t, server.WithFragmentation(wire.FragmentConfig{
+		MTU:         1024,
+		Timeout:     100 * time.Millisecond,
+		MaxBuffered: 5000,
+	}))
+
+	raw, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer raw.Close()
+	// first fragments of messages whose other two fragments never come
+	firstFragment := func(id uint32) {
+		frags, err := wire.Split(bytes.Repeat([]byte{'x'}, 3000), id, 1024)
+		if err != nil {
+			t.Fatalf("Split failed: %v", err)
+		}
+		raw.Write(frags[0])
+	}
+	waitFor := func(what string, cond func(wire.ReassemblyStats) bool) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for !cond(srv.Stats().Reassembly) {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected %s, got %+v", what, srv.Stats().Reassembly)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	firstFragment(1)
+	waitFor("one pending message", func(r wire.ReassemblyStats) bool { return r.Pending == 1 })
+	waitFor("the incomplete message to expire", func(r wire.ReassemblyStats) bool {
+		return r.Expired == 1 && r.Pending == 0 && r.Buffered == 0
+	})
+
+	// five 1014 byte fragments, each with its message's bookkeeping, do not fit in 5000 bytes
+	for id := uint32(2); id <= 6; id++ {
+		firstFragment(id)
+	}
+	waitFor("the oldest message evicted", func(r wire.ReassemblyStats) bool {
+		return r.Evicted == 1 && r.Pending == 4 && r.Buffered <= 5000
+	})
+
+	// the server still reassembles complete messages under pressure
+	cli, err := client.NewUDPClient(addr, 3*time.Second, client.WithFragmentation(wire.FragmentConfig{MTU: 1024}))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer cli.Close()
+	reply, err := cli.Do(context.Background(), bytes.Repeat([]byte{'y'}, 2000))
+	if err != nil || len(reply) != len("ECHO : ")+2000 {
+		t.Fatalf("Expected a 2000 byte echo, got %d bytes (%v)", len(reply), err)
+	}
+}
+
+func TestTFTPTransfersUnderLoss(t *testing.T) {
+	root := t.TempDir()
+	data := make([]byte, 200*1024)
+	rng := rand.New(rand.NewPCG(1, 2))
+	for i := range data {
+		data[i] = byte(rng.Uint32())
+	}
+	if err := os.WriteFile(filepath.Join(root, "big.bin"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "empty"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// requests and acknowledgements are dropped on the way in, data on the way out
+	srv, addr := startUDPServer(t,
+		server.WithTFTP(server.TFTPConfig{Root: root, Writable: true, Timeout: 50 * time.Millisecond, Retries: 10}),
+		server.WithImpairment(netem.Config{Seed: 1, Loss: 0.1}),
+	)
+	srv.SetPacketLoss(0.1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	cli := &client.TFTPClient{Addr: addr, BlockSize: 1428, Timeout: 50 * time.Millisecond, Retries: 10}
+
+	var got bytes.Buffer
+	if n, err := cli.Get(ctx, "/big.bin", &got); err != nil || n != int64(len(data)) {
+		t.Fatalf("Get returned %d bytes (%v), expected %d", n, err, len(data))
+	}
+	if !bytes.Equal(got.Bytes(), data) {
+		t.Fatal("Downloaded file differs from the original")
+	}
+
+	got.Reset()
+	if n, err := cli.Get(ctx, "empty", &got); err != nil || n != 0 {
+		t.Fatalf("Expected an empty download, got %d bytes (%v)", n, err)
+	}
+
+	if n, err := cli.Put(ctx, "uploaded.bin", bytes.NewReader(data[:50000])); err != nil || n != 50000 {
+		t.Fatalf("Put sent %d bytes (%v), expected 50000", n, err)
+	}
+	// the server renames the upload into place right after its final ACK
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		written, err := os.ReadFile(filepath.Join(root, "uploaded.bin"))
+		if err == nil {
+			if !bytes.Equal(written, data[:50000]) {
+				t.Fatal("Uploaded file differs from what was sent")
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Upload never appeared: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// netascii with the default block size: line endings survive the round trip
+	text := &client.TFTPClient{Addr: addr, Mode: tftp.ModeNetASCII, Timeout: 50 * time.Millisecond, Retries: 10}
+	notes := strings.Repeat("one\ntwo\r\nthree\r", 100)
+	if _, err := text.Put(ctx, "notes.txt", strings.NewReader(notes)); err != nil {
+		t.Fatalf("netascii Put failed: %v", err)
+	}
+	deadline = time.Now().Add(2 * time.Second)
+	for {
+		written, err := os.ReadFile(filepath.Join(root, "notes.txt"))
+		if err == nil {
+			if string(written) != notes {
+				t.Fatalf("Expected the text stored as sent, got %q", written)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Upload never appeared: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	got.Reset()
+	if _, err := text.Get(ctx, "notes.txt", &got); err != nil || got.String() != notes {
+		t.Fatalf("Expected the text back unchanged, got %q (%v)", got.String(), err)
+	}
+
+	// retransmitted requests may start extra transfers, and the last ones are still
+	// waiting out their final ACK
+	if st := srv.Stats().TFTP; st.Retransmits == 0 {
+		t.Errorf("Expected loss to cause retransmissions, got %+v", st)
+	}
+}
+
+func TestTFTPErrors(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "taken"), []byte("mine"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+
+	_, addr := startUDPServer(t, server.WithTFTP(server.TFTPConfig{Root: root, Writable: true}))
+	_, readOnlyAddr := startUDPServer(t, server.WithTFTP(server.TFTPConfig{Root: root}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cli := &client.TFTPClient{Addr: addr}
+	readOnly := &client.TFTPClient{Addr: readOnlyAddr}
+
+	tests := []struct {
+		name     string
+		transfer func() (int64, error)
+		code     tftp.ErrorCode
+	}{
+		{"missing file", func() (int64, error) { return cli.Get(ctx, "missing", io.Discard) }, tftp.ErrNotFound},
+		{"parent directory", func() (int64, error) { return cli.Get(ctx, "../secret", io.Discard) }, tftp.ErrAccess},
+		{"symlink out of the root", func() (int64, error) { return cli.Get(ctx, "escape/secret", io.Discard) }, tftp.ErrAccess},
+		{"upload through a symlink", func() (int64, error) {
+			return cli.Put(ctx, "escape/planted", strings.NewReader("x"))
+		}, tftp.ErrAccess},
+		{"directory", func() (int64, error) { return cli.Get(ctx, "/", io.Discard) }, tftp.ErrAccess},
+		{"existing file", func() (int64, error) { return cli.Put(ctx, "taken", strings.NewReader("theirs")) }, tftp.ErrFileExists},
+		{"writes disabled", func() (int64, error) { return readOnly.Put(ctx, "new", strings.NewReader("x")) }, tftp.ErrAccess},
+	}
+	for _, tt := range tests {
+		_, err := tt.transfer()
+		var terr *tftp.Error
+		if !errors.As(err, &terr) || terr.Code != tt.code {
+			t.Errorf("%s: expected tftp error %d, got %v", tt.name, tt.code, err)
+		}
+	}
+
+	if b, _ := os.ReadFile(filepath.Join(root, "taken")); string(b) != "mine" {
+		t.Errorf("Expected the existing file untouched, got %q", b)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "planted")); err == nil {
+		t.Error("Expected no file written outside the root")
+	}
+	entries, _ := os.ReadDir(root)
+	if len(entries) != 2 {
+		t.Errorf("Expected refused uploads to leave nothing behind, found %d entries", len(entries))
+	}
+
+	// a blksize the server cannot honour is lowered, and one it cannot parse refused
+	capped, cappedAddr := startUDPServer(t, server.WithTFTP(server.TFTPConfig{Root: root, MaxBlockSize: 1024}))
+	big := &client.TFTPClient{Addr: cappedAddr, BlockSize: 8192}
+	if _, err := big.Get(ctx, "taken", io.Discard); err != nil {
+		t.Errorf("Expected the server to lower the block size, got %v", err)
+	}
+	if st := capped.Stats().TFTP; st.Failed != 0 {
+		t.Errorf("Expected no failed transfers, got %+v", st)
+	}
+}
+
+// gatedReader blocks its first Read until open is closed.
+type gatedReader struct {
+	open chan struct{}
+	r    io.Reader
+}
+
+func (g *gatedReader) Read(p []byte) (int, error) {
+	<-g.open
+	return g.r.Read(p)
+}
+
+func TestTFTPUploadDoesNotOverwriteRacingFile(t *testing.T) {
+	root := t.TempDir()
+	_, addr := startUDPServer(t, server.WithTFTP(server.TFTPConfig{Root: root, Writable: true}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cli := &client.TFTPClient{Addr: addr}
+
+	// the upload is under way, past the server's check that the name is free, when
+	// someone else takes the name
+	gate := &gatedReader{open: make(chan struct{}), r: strings.NewReader("late upload")}
+	done := make(chan error, 1)
+	go func() {
+		_, err := cli.Put(ctx, "contested", gate)
+		done <- err
+	}()
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		entries, _ := os.ReadDir(root)
+		if len(entries) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the upload to start a temporary file")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := os.WriteFile(filepath.Join(root, "contested"), []byte("first"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	close(gate.open)
+	<-done
+
+	if b, _ := os.ReadFile(filepath.Join(root, "contested")); string(b) != "first" {
+		t.Errorf("Expected the file written first to survive, got %q", b)
+	}
+	if entries, _ := os.ReadDir(root); len(entries) != 1 {
+		t.Errorf("Expected the losing upload to leave nothing behind, found %d entries", len(entries))
+	}
+}
+
+func TestTFTPMaxTransfers(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "file"), []byte("contents"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	srv, addr := startUDPServer(t, server.WithTFTP(server.TFTPConfig{Root: root, MaxTransfers: 1, Timeout: time.Second}))
+
+	// a client that never acknowledges holds the only transfer slot
+	stalled, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer stalled.Close()
+	serverAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stalled.WriteTo(tftp.AppendRequest(nil, tftp.OpRRQ, "file", tftp.ModeOctet, nil), serverAddr)
+	buf := make([]byte, 1024)
+	stalled.SetReadDeadline(time.Now().Add(3 * time.Second))
+	n, _, err := stalled.ReadFrom(buf)
+	if p, perr := tftp.Parse(buf[:n]); err != nil || perr != nil || p.Op != tftp.OpDATA {
+		t.Fatalf("Expected the first block, got %q (%v)", buf[:n], err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cli := &client.TFTPClient{Addr: addr}
+	_, err = cli.Get(ctx, "file", io.Discard)
+	var terr *tftp.Error
+	if !errors.As(err, &terr) || terr.Code != tftp.ErrUndefined {
+		t.Errorf("Expected an ERROR with code 0 while the slot is taken, got %v", err)
+	}
+	if got := srv.Stats().TFTP.Busy; got != 1 {
+		t.Errorf("Expected 1 busy request, got %d", got)
+	}
+}
@@ -0,0 +1,292 @@
+package wire
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// FragmentHeaderLen is the size of everything in front of a fragment's data: the
+// header, then the fragment's index and the message's fragment count, 16 bits each.
+const FragmentHeaderLen = HeaderLen + 4
+
+const maxFragments = 1<<16 - 1
+
+const (
+	// DefaultMTU keeps fragments clear of IP fragmentation on common paths, tunnels
+	// included.
+	DefaultMTU               = 1200
+	DefaultReassemblyTimeout = 5 * time.Second
+	DefaultMaxBuffered       = 4 << 20
+	DefaultMaxPending        = 1024
+	DefaultMaxPendingPerPeer = 64
+)
+
+// partialOverhead approximates what a pending message costs besides its data and
+// fragment slots: the map entry, the key and the bookkeeping struct.
+const partialOverhead = 128
+
+// slotSize is what each of a pending message's fragment slots costs before its
+// fragment arrives.
+const slotSize = int(unsafe.Sizeof([]byte(nil)))
+
+// ErrTooLarge is returned by Split for a datagram that needs more fragments than a
+// fragment header can count.
+var ErrTooLarge = errors.New("datagram needs too many fragments")
+
+// FragmentConfig sets up fragmentation for one end of a conversation. Zero fields take
+// their defaults.
+type FragmentConfig struct {
+	// MTU is the longest datagram sent; anything longer is split into fragments.
+	MTU int
+	// Timeout is how long a partly received message waits for its missing fragments
+	// before it is dropped.
+	Timeout time.Duration
+	// MaxBuffered caps the bytes held by partly received messages from all peers
+	// together, counting each message's fragment slots and bookkeeping as well as its
+	// data. The oldest messages are dropped to make room.
+	MaxBuffered int
+	// MaxPending caps the partly received messages from all peers together, and
+	// MaxPendingPerPeer those from any one peer. The oldest are dropped to make room.
+	MaxPending        int
+	MaxPendingPerPeer int
+}
+
+// WithDefaults fills in the zero fields.
+func (c FragmentConfig) WithDefaults() FragmentConfig {
+	c.MTU = cmp.Or(c.MTU, DefaultMTU)
+	c.Timeout = cmp.Or(c.Timeout, DefaultReassemblyTimeout)
+	c.MaxBuffered = cmp.Or(c.MaxBuffered, DefaultMaxBuffered)
+	c.MaxPending = cmp.Or(c.MaxPending, DefaultMaxPending)
+	c.MaxPendingPerPeer = cmp.Or(c.MaxPendingPerPeer, DefaultMaxPendingPerPeer)
+	return c
+}
+
+// Fragment is one piece of a message.
+type Fragment struct {
+	ID    uint32
+	Index uint16
+	Count uint16
+	Data  []byte
+}
+
+// Split cuts datagram into KindFragment datagrams of at most mtu bytes, all carrying
+// message ID id. A datagram that already fits is returned alone and unchanged.
+func Split(datagram []byte, id uint32, mtu int) ([][]byte, error) {
+	if len(datagram) <= mtu {
+		return [][]byte{datagram}, nil
+	}
+	chunk := mtu - FragmentHeaderLen
+	if chunk <= 0 {
+		return nil, errors.New("mtu too small for a fragment header")
+	}
+	count := (len(datagram) + chunk - 1) / chunk
+	if count > maxFragments {
+		return nil, ErrTooLarge
+	}
+
+	frags := make([][]byte, 0, count)
+	for i := range count {
+		data := datagram[i*chunk : min((i+1)*chunk, len(datagram))]
+		b := make([]byte, 0, FragmentHeaderLen+len(data))
+		b = Append(b, Header{Kind: KindFragment, Seq: id}, nil)
+		b = binary.BigEndian.AppendUint16(b, uint16(i))
+		b = binary.BigEndian.AppendUint16(b, uint16(count))
+		frags = append(frags, append(b, data...))
+	}
+	return frags, nil
+}
+
+// ParseFragment reads the fragment in the payload of a KindFragment datagram with
+// header h. Data aliases payload. Fragments without data, or whose index is not
+// below their count, are rejected.
+func ParseFragment(h Header, payload []byte) (Fragment, bool) {
+	if h.Kind != KindFragment || len(payload) < FragmentHeaderLen-HeaderLen {
+		return Fragment{}, false
+	}
+	f := Fragment{
+		ID:    h.Seq,
+		Index: binary.BigEndian.Uint16(payload[0:2]),
+		Count: binary.BigEndian.Uint16(payload[2:4]),
+		Data:  payload[4:],
+	}
+	if !f.valid() {
+		return Fragment{}, false
+	}
+	return f, true
+}
+
+func (f Fragment) valid() bool {
+	return f.Count > 0 && f.Index < f.Count && len(f.Data) > 0
+}
+
+// ReassemblyStats counts what became of fragmented messages.
+type ReassemblyStats struct {
+	Reassembled uint64
+	// Expired counts messages dropped because a fragment did not arrive in time.
+	Expired uint64
+	// Evicted counts messages dropped, or refused, to stay under MaxBuffered,
+	// MaxPending and MaxPendingPerPeer.
+	Evicted uint64
+	// Pending messages are charged Buffered bytes between them.
+	Pending  int
+	Buffered int
+}
+
+// Reassembler puts fragments back together into the datagrams they were split from.
+// It is safe for concurrent use.
+type Reassembler struct {
+	cfg FragmentConfig
+
+	mu        sync.Mutex
+	partial   map[partialKey]*partial
+	perPeer   map[string]int
+	buffered  int
+	lastSweep time.Time
+	stats     ReassemblyStats
+}
+
+// partialKey tells apart messages from different peers that use the same ID.
+type partialKey struct {
+	from string
+	id   uint32
+}
+
+type partial struct {
+	parts   [][]byte
+	have    int
+	size    int
+	started time.Time
+}
+
+func NewReassembler(cfg FragmentConfig) *Reassembler {
+	return &Reassembler{
+		cfg:     cfg.WithDefaults(),
+		partial: make(map[partialKey]*partial),
+		perPeer: make(map[string]int),
+	}
+}
+
+// Add stores f, received from the peer named from, and returns the whole datagram
+// once f completes it. Duplicate, inconsistent and invalid fragments are ignored.
+func (r *Reassembler) Add(from string, f Fragment) ([]byte, bool) {
+	if !f.valid() {
+		return nil, false
+	}
+	now := time.Now()
+	key := partialKey{from: from, id: f.ID}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expire(now)
+
+	p := r.partial[key]
+	cost := len(f.Data)
+	if p == nil {
+		// the first fragment decides the count, and so the slots every message pays for
+		cost += partialCost(f.Count)
+	} else if len(p.parts) != int(f.Count) || p.parts[f.Index] != nil {
+		return nil, false
+	}
+	if cost > r.cfg.MaxBuffered {
+		r.stats.Evicted++
+		r.drop(key)
+		return nil, false
+	}
+	if p == nil {
+		for r.perPeer[from] >= r.cfg.MaxPendingPerPeer {
+			r.evict(r.oldest(func(k partialKey) bool { return k.from == from }))
+		}
+		for len(r.partial) >= r.cfg.MaxPending {
+			r.evict(r.oldest(func(partialKey) bool { return true }))
+		}
+	}
+	for r.buffered+cost > r.cfg.MaxBuffered {
+		oldest := r.oldest(func(partialKey) bool { return true })
+		r.evict(oldest)
+		if oldest == key {
+			return nil, false
+		}
+	}
+
+	if p == nil {
+		p = &partial{parts: make([][]byte, f.Count), size: partialCost(f.Count), started: now}
+		r.partial[key] = p
+		r.perPeer[from]++
+		r.buffered += p.size
+	}
+	p.parts[f.Index] = bytes.Clone(f.Data)
+	p.have++
+	p.size += len(f.Data)
+	r.buffered += len(f.Data)
+	if p.have < len(p.parts) {
+		return nil, false
+	}
+
+	r.drop(key)
+	r.stats.Reassembled++
+	return bytes.Join(p.parts, nil), true
+}
+
+// partialCost is what a pending message of count fragments is charged before any of
+// its data.
+func partialCost(count uint16) int {
+	return partialOverhead + int(count)*slotSize
+}
+
+// Stats also drops the messages that have timed out since the last fragment arrived.
+func (r *Reassembler) Stats() ReassemblyStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expire(time.Now())
+	stats := r.stats
+	stats.Pending = len(r.partial)
+	stats.Buffered = r.buffered
+	return stats
+}
+
+// expire drops messages older than the timeout, checking at most a few times per
+// timeout so a stream of fragments does not rescan every pending message.
+func (r *Reassembler) expire(now time.Time) {
+	if now.Sub(r.lastSweep) < r.cfg.Timeout/4 {
+		return
+	}
+	r.lastSweep = now
+	for key, p := range r.partial {
+		if now.Sub(p.started) > r.cfg.Timeout {
+			r.stats.Expired++
+			r.drop(key)
+		}
+	}
+}
+
+// oldest returns the longest pending message among those match accepts.
+func (r *Reassembler) oldest(match func(partialKey) bool) partialKey {
+	var key partialKey
+	var started time.Time
+	for k, p := range r.partial {
+		if match(k) && (started.IsZero() || p.started.Before(started)) {
+			key, started = k, p.started
+		}
+	}
+	return key
+}
+
+func (r *Reassembler) evict(key partialKey) {
+	r.stats.Evicted++
+	r.drop(key)
+}
+
+func (r *Reassembler) drop(key partialKey) {
+	if p := r.partial[key]; p != nil {
+		r.buffered -= p.size
+		delete(r.partial, key)
+		if r.perPeer[key.from]--; r.perPeer[key.from] == 0 {
+			delete(r.perPeer, key.from)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package wire_test
+
+import (
+	"testing"
+
+	"github.com/pixperk/bloodsport/day1_tcp_udp/udp_echo/wire"
+)
+
+func TestReassemblerBounds(t *testing.T) {
+	r := wire.NewReassembler(wire.FragmentConfig{MaxBuffered: 64 << 10, MaxPending: 4, MaxPendingPerPeer: 2})
+	first := func(from string, id uint32, count uint16) {
+		t.Helper()
+		if _, done := r.Add(from, wire.Fragment{ID: id, Count: count, Data: []byte("x")}); done {
+			t.Fatalf("Expected message %d from %q to stay pending", id, from)
+		}
+	}
+
+	// empty data and counts whose slots alone exceed MaxBuffered are refused up front
+	r.Add("a", wire.Fragment{ID: 1, Count: 2})
+	first("a", 2, 65535)
+	if stats := r.Stats(); stats.Pending != 0 || stats.Buffered != 0 || stats.Evicted != 1 {
+		t.Fatalf("Expected nothing buffered and the oversized count refused, got %+v", stats)
+	}
+
+	// a peer holds at most two messages
+	for id := uint32(1); id <= 3; id++ {
+		first("a", id, 2)
+	}
+	if stats := r.Stats(); stats.Pending != 2 || stats.Evicted != 2 {
+		t.Fatalf("Expected the per-peer cap to evict one message, got %+v", stats)
+	}
+
+	// and all peers together at most four
+	for _, from := range []string{"b", "c", "d"} {
+		first(from, 1, 2)
+	}
+	stats := r.Stats()
+	if stats.Pending != 4 || stats.Evicted != 3 {
+		t.Fatalf("Expected the total cap to evict one message, got %+v", stats)
+	}
+	if stats.Buffered <= stats.Pending {
+		t.Errorf("Expected bookkeeping to be charged besides the data, got %+v", stats)
+	}
+
+	if whole, done := r.Add("e", wire.Fragment{ID: 1, Count: 1, Data: []byte("whole")}); !done || string(whole) != "whole" {
+		t.Errorf("Expected a one-fragment message to complete at once, got %q", whole)
+	}
+}
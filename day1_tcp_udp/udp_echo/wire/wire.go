@@ -0,0 +1,57 @@
+// Package wire frames the datagrams exchanged by the UDP echo client and server when
+// they use more than plain echo. A framed datagram starts with Magic, a known Kind byte
+// and a 32-bit sequence number or request ID; anything else is a plain message and is
+// echoed as is.
+package wire
+
+import "encoding/binary"
+
+// Magic opens every framed datagram. A plain message that happens to start with it and
+// a known Kind is taken for a framed one.
+const Magic = 0xEC
+
+// HeaderLen is the size of the header in front of a framed payload.
+const HeaderLen = 6
+
+type Kind uint8
+
+const (
+	// KindData carries a message the sender wants acknowledged.
+	KindData Kind = 1
+	// KindAck acknowledges the KindData with the same sequence number and carries
+	// the reply to it.
+	KindAck Kind = 2
+	// KindRequest asks for one reply, without retransmission; Seq is the request ID.
+	KindRequest Kind = 3
+	// KindResponse answers the KindRequest with the same ID.
+	KindResponse Kind = 4
+	// KindFragment carries one piece of a datagram too long for the path; Seq is the
+	// message ID its pieces share. See Split.
+	KindFragment Kind = 5
+)
+
+func (k Kind) known() bool {
+	return k >= KindData && k <= KindFragment
+}
+
+type Header struct {
+	Kind Kind
+	Seq  uint32
+}
+
+// Append appends the framed datagram for h and payload to dst.
+func Append(dst []byte, h Header, payload []byte) []byte {
+	dst = append(dst, Magic, byte(h.Kind))
+	dst = binary.BigEndian.AppendUint32(dst, h.Seq)
+	return append(dst, payload...)
+}
+
+// Parse splits a framed datagram into its header and payload. It reports false for a
+// plain message, including one that starts with Magic but not a known Kind.
+func Parse(b []byte) (Header, []byte, bool) {
+	if len(b) < HeaderLen || b[0] != Magic || !Kind(b[1]).known() {
+		return Header{}, nil, false
+	}
+	h := Header{Kind: Kind(b[1]), Seq: binary.BigEndian.Uint32(b[2:HeaderLen])}
+	return h, b[HeaderLen:], true
+}
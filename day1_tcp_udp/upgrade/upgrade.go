@@ -0,0 +1,65 @@
+// Package upgrade restarts a server without dropping its listening sockets. The
+// running process execs a new copy of itself that inherits the listeners as file
+// descriptors; once the child reports Ready the parent stops accepting, drains its
+// connections and exits, while the child accepts on the same sockets.
+//
+// A server opts in by listening through Listen, calling Ready once it is serving and
+// calling Upgrade when asked to restart (conventionally on SIGHUP or SIGUSR2).
+package upgrade
+
+import (
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+const (
+	// envListenFDs holds the number of listeners inherited from the parent. They
+	// occupy the descriptors straight after stderr.
+	envListenFDs = "UPGRADE_LISTEN_FDS"
+
+	// envReadyFD names the descriptor Ready writes to.
+	envReadyFD = "UPGRADE_READY_FD"
+
+	// firstFD is the descriptor of the first entry in exec.Cmd.ExtraFiles.
+	firstFD = 3
+)
+
+// defaultReadyTimeout bounds how long Upgrade waits for the child to call Ready.
+const defaultReadyTimeout = 30 * time.Second
+
+var ErrChildFailed = errors.New("upgrade: child exited before it was ready")
+
+// Upgrader describes how to start the child process. The zero value re-execs the
+// running binary with the same arguments and environment.
+type Upgrader struct {
+	// Path and Args start the child; Args includes the program name as in exec.Cmd.
+	Path string
+	Args []string
+
+	// Env is added to the parent's environment for the child.
+	Env []string
+
+	// ReadyTimeout bounds the wait for the child's Ready call; the child is killed if
+	// it expires. Zero means 30s.
+	ReadyTimeout time.Duration
+}
+
+// Upgrade starts the child with a zero Upgrader; see Upgrader.Upgrade.
+func Upgrade(listeners ...net.Listener) (*os.Process, error) {
+	var u Upgrader
+	return u.Upgrade(listeners...)
+}
+
+// Listen returns the next listener inherited for network, or a new listener on
+// address when there is none left, so the first process and every upgraded child
+// can share one code path. Listeners are handed over in the order they were passed to
+// Upgrade and should be requested in the same order.
+func Listen(network, address string) (net.Listener, error) {
+	lis, err := takeInherited(network)
+	if err != nil || lis != nil {
+		return lis, err
+	}
+	return net.Listen(network, address)
+}
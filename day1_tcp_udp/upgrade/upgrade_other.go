@@ -0,0 +1,19 @@
+//go:build !unix
+
+package upgrade
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+func takeInherited(network string) (net.Listener, error) { return nil, nil }
+
+// Ready is a no-op where descriptor handoff is unsupported.
+func Ready() error { return nil }
+
+// Upgrade always fails where descriptor handoff is unsupported.
+func (u *Upgrader) Upgrade(listeners ...net.Listener) (*os.Process, error) {
+	return nil, errors.ErrUnsupported
+}
@@ -0,0 +1,181 @@
+//go:build unix
+
+package upgrade
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var inherited struct {
+	once      sync.Once
+	mu        sync.Mutex
+	listeners []net.Listener
+	err       error
+}
+
+// loadInherited turns the descriptors named by envListenFDs into listeners once, and
+// clears the variable so a later child of this process does not see stale descriptors.
+func loadInherited() {
+	inherited.once.Do(func() {
+		n, _ := strconv.Atoi(os.Getenv(envListenFDs))
+		os.Unsetenv(envListenFDs)
+		for i := range n {
+			f := os.NewFile(uintptr(firstFD+i), "inherited-listener-"+strconv.Itoa(i))
+			lis, err := net.FileListener(f)
+			f.Close()
+			if err != nil {
+				inherited.err = fmt.Errorf("upgrade: inherited descriptor %d: %w", firstFD+i, err)
+				return
+			}
+			inherited.listeners = append(inherited.listeners, lis)
+		}
+	})
+}
+
+func takeInherited(network string) (net.Listener, error) {
+	loadInherited()
+	inherited.mu.Lock()
+	defer inherited.mu.Unlock()
+	if inherited.err != nil {
+		return nil, inherited.err
+	}
+	for i, lis := range inherited.listeners {
+		if lis.Addr().Network() == network {
+			inherited.listeners = append(inherited.listeners[:i], inherited.listeners[i+1:]...)
+			return lis, nil
+		}
+	}
+	return nil, nil
+}
+
+// Ready tells the parent that this child is serving, letting it start to drain. It is
+// a no-op in a process not started by Upgrade.
+func Ready() error {
+	fd, err := strconv.Atoi(os.Getenv(envReadyFD))
+	if err != nil {
+		return nil
+	}
+	os.Unsetenv(envReadyFD)
+	f := os.NewFile(uintptr(fd), "upgrade-ready")
+	defer f.Close()
+	_, err = f.Write([]byte{1})
+	return err
+}
+
+// dupListener duplicates lis's descriptor for the child. It avoids the listener's File
+// method: exec would put that copy into blocking mode, and as the mode is shared by
+// both copies the parent's Accept could then no longer be interrupted by Close.
+func dupListener(lis net.Listener) (*os.File, error) {
+	sc, ok := lis.(syscall.Conn)
+	if !ok {
+		return nil, fmt.Errorf("upgrade: cannot hand over %T", lis)
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return nil, fmt.Errorf("upgrade: %w", err)
+	}
+
+	var fd int
+	var dupErr error
+	err = rc.Control(func(s uintptr) {
+		syscall.ForkLock.RLock()
+		defer syscall.ForkLock.RUnlock()
+		if fd, dupErr = syscall.Dup(int(s)); dupErr == nil {
+			syscall.CloseOnExec(fd)
+		}
+	})
+	if err == nil {
+		err = dupErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("upgrade: %w", err)
+	}
+	return os.NewFile(uintptr(fd), lis.Addr().String()), nil
+}
+
+// Upgrade starts the child with duplicates of listeners and waits for it to call
+// Ready. The caller keeps its listeners open and should shut down gracefully once
+// Upgrade returns; if it fails the caller carries on serving.
+func (u *Upgrader) Upgrade(listeners ...net.Listener) (*os.Process, error) {
+	files := make([]*os.File, 0, len(listeners)+1)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, lis := range listeners {
+		f, err := dupListener(lis)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("upgrade: %w", err)
+	}
+	defer readyR.Close()
+	files = append(files, readyW)
+
+	path, args := u.Path, u.Args
+	if path == "" {
+		if path, err = os.Executable(); err != nil {
+			return nil, fmt.Errorf("upgrade: %w", err)
+		}
+		args = os.Args
+	}
+	cmd := &exec.Cmd{
+		Path:       path,
+		Args:       args,
+		Stdin:      os.Stdin,
+		Stdout:     os.Stdout,
+		Stderr:     os.Stderr,
+		ExtraFiles: files,
+		Env: append(append(os.Environ(), u.Env...),
+			envListenFDs+"="+strconv.Itoa(len(listeners)),
+			envReadyFD+"="+strconv.Itoa(firstFD+len(listeners)),
+		),
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("upgrade: %w", err)
+	}
+	// our copy of the write end must go, or a crashed child would never show as EOF
+	readyW.Close()
+	files = files[:len(files)-1]
+
+	timeout := u.ReadyTimeout
+	if timeout <= 0 {
+		timeout = defaultReadyTimeout
+	}
+	readyR.SetReadDeadline(time.Now().Add(timeout))
+
+	var b [1]byte
+	if _, err := readyR.Read(b[:]); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		if errors.Is(err, io.EOF) {
+			return nil, ErrChildFailed
+		}
+		return nil, fmt.Errorf("upgrade: waiting for child: %w", err)
+	}
+	// the child now owns the socket paths; closing ours must not remove them. Until
+	// it is serving they stay ours, to clean up should we carry on alone.
+	for _, lis := range listeners {
+		if ul, ok := lis.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	// reap the child whenever it exits so it never lingers as a zombie
+	go cmd.Wait()
+	return cmd.Process, nil
+}